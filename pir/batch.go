@@ -0,0 +1,365 @@
+package pir
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Batch PIR for arbitrary sets of indexes, by cuckoo hashing.
+//
+// The server replicates each record into the CuckooHashes distinct buckets that
+// it hashes to, under a public hash key, and runs an independent instance of
+// the underlying PIR scheme on each bucket (all buckets are padded to the same
+// size, so they share Params and the shared state). To fetch k indexes in one
+// round, the client cuckoo-hashes them into the Num_buckets buckets, so that
+// each bucket holds at most one of them, and queries every bucket: for its
+// assigned index, or for a dummy one. The server thus learns nothing about
+// which, or how many, buckets hold real queries.
+//
+// Insertion fails (returning ErrCuckooFailed) only if the indexes cannot be
+// placed in buckets of their own at all. As the hash key is public, a failure
+// would tell the server something about the indexes, so Num_buckets is picked
+// for a failure probability of at most 2^cuckooLogFailure, for every k: it is
+// CuckooExpansion*k for large k, and larger for small k (e.g., 41 buckets for
+// k = 4). As each record is in CuckooHashes buckets whatever their number, the
+// extra buckets cost communication, but not server work.
+
+const CuckooHashes = 3
+const CuckooExpansion = 1.5 // least number of buckets per index
+const cuckooLogFailure = -40
+
+var ErrCuckooFailed = errors.New("pir: could not cuckoo-hash the batch of indexes")
+
+type BatchPIR struct {
+	PIR        PIR
+	Num        uint64 // number of DB entries
+	Row_length uint64 // number of bits per DB entry
+	K          uint64 // max number of indexes per batch
+
+	Num_buckets uint64
+	Bucket_size uint64  // number of entries per bucket (after padding)
+	Key         *PRGKey // public key of the hash functions
+	Params      Params  // params of the PIR instance on each bucket
+
+	info    DBinfo
+	hash    cipher.Block
+	buckets [][]uint64 // DB indexes in each bucket, in increasing order
+}
+
+// Lays out the records of a database of Num entries of row_length bits into
+// buckets for batches of up to k indexes, hashing with key (which the server
+// picks and publishes), and picks the params of the underlying scheme pi for
+// the buckets. Both client and server compute the layout, which depends only on
+// these public values.
+func NewBatchPIR(pi PIR, Num, row_length, k uint64, key *PRGKey, n, logq uint64) *BatchPIR {
+	if k == 0 {
+		panic("Need at least one query")
+	}
+
+	b := &BatchPIR{
+		PIR:         pi,
+		Num:         Num,
+		Row_length:  row_length,
+		K:           k,
+		Num_buckets: cuckooBuckets(k),
+		Key:         key,
+	}
+
+	var err error
+	b.hash, err = aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	b.buckets = make([][]uint64, b.Num_buckets)
+	for i := uint64(0); i < Num; i++ {
+		for _, bkt := range b.bucketsOf(i) {
+			b.buckets[bkt] = append(b.buckets[bkt], i)
+		}
+	}
+	for _, bucket := range b.buckets {
+		if uint64(len(bucket)) > b.Bucket_size {
+			b.Bucket_size = uint64(len(bucket))
+		}
+	}
+
+	b.Params = pi.PickParams(b.Bucket_size, row_length, n, logq)
+
+	// the bucket databases, once set up
+	b.info = SetupDB(b.Bucket_size, row_length, &b.Params).Info
+	b.info.Basis = 10
+	b.info.Squishing = 3
+	b.info.Cols = b.Params.M
+	return b
+}
+
+// Returns an upper bound on the probability that k indexes, each hashed to
+// CuckooHashes distinct random buckets out of num_buckets, cannot be placed in
+// buckets of their own. By Hall's theorem, this happens only if some s of the
+// indexes hash into s-1 buckets in all; the bound sums the probability of this
+// over every set of s indexes and s-1 buckets.
+func cuckooFailureBound(k, num_buckets uint64) float64 {
+	logBinom := func(n, r uint64) float64 {
+		a, _ := math.Lgamma(float64(n + 1))
+		b, _ := math.Lgamma(float64(r + 1))
+		c, _ := math.Lgamma(float64(n - r + 1))
+		return a - b - c
+	}
+
+	bound := 0.0
+	for s := uint64(CuckooHashes + 1); s <= k && s-1 <= num_buckets; s++ {
+		// each of the s indexes hashes into the s-1 buckets
+		within := logBinom(s-1, CuckooHashes) - logBinom(num_buckets, CuckooHashes)
+		bound += math.Exp(logBinom(k, s) + logBinom(num_buckets, s-1) + float64(s)*within)
+	}
+	return bound
+}
+
+// Returns the least number of buckets, and at least CuckooExpansion*k, for
+// which batches of k indexes fail to cuckoo-hash with probability at most
+// 2^cuckooLogFailure.
+func cuckooBuckets(k uint64) uint64 {
+	ok := func(num_buckets uint64) bool {
+		return cuckooFailureBound(k, num_buckets) <= math.Exp2(cuckooLogFailure)
+	}
+
+	lo := uint64(math.Ceil(CuckooExpansion * float64(k)))
+	if lo < CuckooHashes {
+		lo = CuckooHashes
+	}
+	if ok(lo) {
+		return lo
+	}
+
+	// the bound falls as the number of buckets grows
+	hi := 2 * lo
+	for !ok(hi) {
+		lo, hi = hi, 2*hi
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if ok(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
+
+// Returns the CuckooHashes distinct buckets that DB entry i is replicated into.
+func (b *BatchPIR) bucketsOf(i uint64) []uint64 {
+	var in, out [aes.BlockSize]byte
+	var bkts []uint64
+	for t := uint64(0); len(bkts) < CuckooHashes; t++ {
+		binary.LittleEndian.PutUint64(in[0:8], i)
+		binary.LittleEndian.PutUint64(in[8:16], t)
+		b.hash.Encrypt(out[:], in[:])
+		bkt := binary.LittleEndian.Uint64(out[:8]) % b.Num_buckets
+
+		dup := false
+		for _, prev := range bkts {
+			dup = dup || (prev == bkt)
+		}
+		if !dup {
+			bkts = append(bkts, bkt)
+		}
+	}
+	return bkts
+}
+
+// Returns the position of DB entry i within bucket bkt.
+func (b *BatchPIR) position(bkt, i uint64) uint64 {
+	bucket := b.buckets[bkt]
+	pos := sort.Search(len(bucket), func(j int) bool { return bucket[j] >= i })
+	if pos == len(bucket) || bucket[pos] != i {
+		panic("Entry is not in bucket")
+	}
+	return uint64(pos)
+}
+
+// Returns the DBinfo of the (set up) bucket databases, which clients need to
+// build queries.
+func (b *BatchPIR) Info() DBinfo {
+	return b.info
+}
+
+// Builds the bucket databases from the DB entries vals.
+func (b *BatchPIR) MakeDBs(vals []uint64) []*Database {
+	if uint64(len(vals)) != b.Num {
+		panic("Bad input DB")
+	}
+
+	DBs := make([]*Database, b.Num_buckets)
+	for bkt, bucket := range b.buckets {
+		bucket_vals := make([]uint64, b.Bucket_size)
+		for j, i := range bucket {
+			bucket_vals[j] = vals[i]
+		}
+		DBs[bkt] = MakeDB(b.Bucket_size, b.Row_length, &b.Params, bucket_vals)
+	}
+	return DBs
+}
+
+func (b *BatchPIR) Init() State {
+	return b.PIR.Init(b.Info(), b.Params)
+}
+
+// Sets up every bucket, returning the server state and the hint of each.
+func (b *BatchPIR) Setup(DBs []*Database, shared State) ([]State, []Msg) {
+	servers := make([]State, len(DBs))
+	hints := make([]Msg, len(DBs))
+	for bkt, DB := range DBs {
+		servers[bkt], hints[bkt] = b.PIR.Setup(DB, shared, b.Params)
+	}
+	return servers, hints
+}
+
+// Client state for one batch: for each bucket, the DB entry queried in it (or
+// none), and the client state of its query.
+type BatchState struct {
+	Indexes []uint64
+	Entries []int64 // entry queried in each bucket, or -1 for a dummy query
+	Clients []State
+}
+
+// Places the distinct DB entries in indexes in buckets of their own, among the
+// buckets that they are replicated into. Returns the entry placed in each
+// bucket (or -1), or ErrCuckooFailed if there is no such placement.
+func (b *BatchPIR) place(indexes []uint64) ([]int64, error) {
+	entries := make([]int64, b.Num_buckets)
+	for bkt := range entries {
+		entries[bkt] = -1
+	}
+
+	placed := make(map[uint64]bool)
+	for _, i := range indexes {
+		if i >= b.Num {
+			panic("Index out of range")
+		}
+		if placed[i] {
+			continue
+		}
+		placed[i] = true
+
+		// if no augmenting path places i, no placement of these entries exists
+		if !b.augment(int64(i), entries, make([]bool, b.Num_buckets)) {
+			return nil, ErrCuckooFailed
+		}
+	}
+	return entries, nil
+}
+
+// Places entry i, moving entries that were placed before along an augmenting
+// path through the buckets not yet visited.
+func (b *BatchPIR) augment(i int64, entries []int64, visited []bool) bool {
+	for _, bkt := range b.bucketsOf(uint64(i)) {
+		if visited[bkt] {
+			continue
+		}
+		visited[bkt] = true
+		if entries[bkt] < 0 || b.augment(entries[bkt], entries, visited) {
+			entries[bkt] = i
+			return true
+		}
+	}
+	return false
+}
+
+// Builds a query for the DB entries indexes (at most K of them; they need not
+// be distinct), made of one query per bucket.
+func (b *BatchPIR) Query(indexes []uint64, shared State) (*BatchState, MsgSlice, error) {
+	if uint64(len(indexes)) > b.K {
+		panic("Too many indexes for batch")
+	}
+
+	entries, err := b.place(indexes)
+	if err != nil {
+		return nil, MsgSlice{}, err
+	}
+	st := &BatchState{
+		Indexes: indexes,
+		Entries: entries,
+	}
+
+	var query MsgSlice
+	for bkt, i := range st.Entries {
+		pos := uint64(0)
+		if i >= 0 {
+			pos = b.position(uint64(bkt), uint64(i))
+		}
+		client, q := b.PIR.Query(pos, shared, b.Params, b.info)
+		st.Clients = append(st.Clients, client)
+		query.Data = append(query.Data, q)
+	}
+	return st, query, nil
+}
+
+// Answers a batch query, by answering each bucket's query on its bucket.
+// Returns an error if DBs, servers or query do not hold one element per
+// bucket, or if the query for some bucket is malformed.
+func (b *BatchPIR) Answer(DBs []*Database, query MsgSlice, servers []State, shared State) (MsgSlice, error) {
+	if uint64(len(DBs)) != b.Num_buckets || uint64(len(servers)) != b.Num_buckets {
+		return MsgSlice{}, fmt.Errorf("pir: got %d bucket DBs and %d server states, want %d",
+			len(DBs), len(servers), b.Num_buckets)
+	}
+	if uint64(len(query.Data)) != b.Num_buckets {
+		return MsgSlice{}, fmt.Errorf("%w: got queries for %d buckets, want %d", ErrMalformedQuery,
+			len(query.Data), b.Num_buckets)
+	}
+
+	var answer MsgSlice
+	for bkt, DB := range DBs {
+		a, err := b.PIR.AnswerCtx(context.Background(), DB, MakeMsgSlice(query.Data[bkt]), servers[bkt],
+			shared, b.Params)
+		if err != nil {
+			return MsgSlice{}, err
+		}
+		answer.Data = append(answer.Data, a)
+	}
+	return answer, nil
+}
+
+// Recovers the DB entries that st queried for, in the order of st.Indexes.
+// Returns an error if the answer does not hold an answer of the right shape for
+// each bucket.
+func (b *BatchPIR) Recover(st *BatchState, hints []Msg, query MsgSlice, answer MsgSlice,
+	shared State) ([]uint64, error) {
+	if uint64(len(answer.Data)) != b.Num_buckets {
+		return nil, fmt.Errorf("%w: got answers for %d buckets, want %d", ErrMalformedAnswer,
+			len(answer.Data), b.Num_buckets)
+	}
+
+	recovered := make(map[uint64]uint64)
+	for bkt, i := range st.Entries {
+		if i < 0 {
+			continue
+		}
+		pos := b.position(uint64(bkt), uint64(i))
+		val, err := RecoverChecked(b.PIR, pos, 0, 1, hints[bkt], query.Data[bkt], answer.Data[bkt],
+			shared, st.Clients[bkt], b.Params, b.info)
+		if err != nil {
+			return nil, err
+		}
+		recovered[uint64(i)] = val
+	}
+
+	vals := make([]uint64, len(st.Indexes))
+	for j, i := range st.Indexes {
+		vals[j] = recovered[i]
+	}
+	return vals, nil
+}
+
+// Resets the bucket databases to their state before Setup.
+func (b *BatchPIR) Reset(DBs []*Database) {
+	for _, DB := range DBs {
+		b.PIR.Reset(DB, b.Params)
+	}
+}
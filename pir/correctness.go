@@ -0,0 +1,139 @@
+package pir
+
+import "math"
+
+// Empirical and analytic correctness of a PIR scheme on one parameter set.
+type CorrectnessReport struct {
+	Scheme     string
+	Params     Params
+	Row_length uint64
+
+	Queries  uint64 // random queries made
+	Failures uint64 // queries that recovered the wrong record
+	Flagged  uint64 // queries whose NoiseReport flagged a probable failure
+
+	Noise NoiseStats // empirical noise in the decoded Z_p elems of the records
+	Inner NoiseStats // DoublePIR only: empirical noise in the inner layer
+
+	// Analytic (worst-case) stddev of the noise, and the resulting probability
+	// that a single decoded Z_p elem is wrong, treating the noise as Gaussian.
+	Bound           float64
+	Inner_bound     float64
+	Elem_fail_prob  float64
+	Inner_fail_prob float64
+
+	Gauss NoiseStats // empirical distribution of MatrixGaussian's samples
+}
+
+// Analytic stddev of the noise in an LWE ciphertext that is the inner product
+// of dim Z_p elems (centered in [-p/2, p/2]) with a fresh LWE error vector:
+// sigma * sqrt(dim) * p/2.
+func noiseBound(p Params, dim uint64) float64 {
+	return p.Sigma * math.Sqrt(float64(dim)) * float64(p.P) / 2
+}
+
+// Probability that Gaussian noise of the given stddev exceeds Delta/2.
+func gaussianFailProb(p Params, stddev float64) float64 {
+	return math.Erfc(float64(p.Delta()/2) / (stddev * math.Sqrt2))
+}
+
+// Stddev of noise of the given stddev after the answer is switched to modulus
+// 2^p.Logq_answer, which adds a rounding error that is uniform in
+// [-2^(shift-1), 2^(shift-1)], for shift = Logq - Logq_answer.
+func switchedNoiseBound(p Params, stddev float64) float64 {
+	shift := p.Logq - p.answerLogq()
+	if shift == 0 {
+		return stddev
+	}
+	r := math.Ldexp(1, int(shift))
+	return math.Sqrt(stddev*stddev + r*r/12)
+}
+
+// Returns the smallest Logq_answer to which answers whose noise has the given
+// stddev can be switched while at most doubling the probability that a
+// decoded Z_p elem is wrong.
+func pickAnswerLogq(p Params, stddev float64) uint64 {
+	base := gaussianFailProb(p, stddev)
+	logq := p.Logq
+	for logq > 1 {
+		p.Logq_answer = logq - 1
+		if gaussianFailProb(p, switchedNoiseBound(p, stddev)) > 2*base {
+			break
+		}
+		logq -= 1
+	}
+	return logq
+}
+
+// Measures the empirical distribution of num_samples draws from MatrixGaussian.
+func MeasureGaussian(num_samples uint64) NoiseStats {
+	m := MatrixGaussian(num_samples, 1)
+	samples := make([]int64, num_samples)
+	for i, v := range m.Data {
+		samples[i] = int64(int32(v))
+	}
+	return summarizeNoise(samples)
+}
+
+// Runs num_queries queries for uniformly random indexes against DB (which must
+// not be set up yet), checks every recovered record, and compares the noise
+// observed while decoding to its analytic bound. DB is set up and then reset.
+func MeasureCorrectness(pi PIR, DB *Database, p Params, num_queries uint64) *CorrectnessReport {
+	r := &CorrectnessReport{
+		Scheme:     pi.Name(),
+		Params:     p,
+		Row_length: DB.Info.Row_length,
+		Queries:    num_queries,
+	}
+
+	// Pick the indexes, and read out the records, while the DB is unpacked
+	rand := MathRand()
+	indexes := make([]uint64, num_queries)
+	expected := make([]uint64, num_queries)
+	for q := range indexes {
+		indexes[q] = uint64(rand.Int63n(int64(DB.Info.Num)))
+		expected[q] = DB.GetElem(indexes[q])
+	}
+
+	shared := pi.Init(DB.Info, p)
+	server, offline := pi.Setup(DB, shared, p)
+
+	noise := &NoiseReport{}
+	for q, i := range indexes {
+		client, query := pi.Query(i, shared, p, DB.Info)
+		answer := pi.Answer(DB, MakeMsgSlice(query), server, shared, p)
+		val, report := pi.RecoverNoise(i, 0, offline, query, answer, shared, client, p, DB.Info)
+
+		if val != expected[q] {
+			r.Failures += 1
+		}
+		if report.ProbableFailure() {
+			r.Flagged += 1
+		}
+		noise.Merge(report)
+	}
+	pi.Reset(DB, p)
+
+	r.Noise = noise.Stats()
+	r.Bound = noiseBound(p, p.M)
+
+	// answers are switched to 2^Logq_answer in the layer that is decoded from
+	// them: the inner one of DoublePIR, and the only one of the others
+	r.Inner = noise.InnerStats()
+	if r.Inner.Count > 0 {
+		r.Inner_bound = switchedNoiseBound(p, noiseBound(p, p.L/DB.Info.X))
+		r.Inner_fail_prob = gaussianFailProb(p, r.Inner_bound)
+	} else {
+		r.Bound = switchedNoiseBound(p, r.Bound)
+	}
+	r.Elem_fail_prob = gaussianFailProb(p, r.Bound)
+
+	r.Gauss = MeasureGaussian(p.M)
+
+	logger.Info("measured correctness", "scheme", r.Scheme, "n", p.N, "l", p.L, "m", p.M,
+		"p", p.P, "row_length", r.Row_length, "queries", r.Queries, "failures", r.Failures,
+		"flagged", r.Flagged, "noise_stddev", r.Noise.Stddev, "noise_max", r.Noise.Max,
+		"bound", r.Bound, "elem_fail_prob", r.Elem_fail_prob, "gauss_stddev", r.Gauss.Stddev)
+
+	return r
+}
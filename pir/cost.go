@@ -0,0 +1,60 @@
+package pir
+
+import "fmt"
+
+// Predicted costs of running a PIR scheme on a database. Communication and
+// memory are in KB; operation counts are numbers of (32-bit) multiply-adds.
+type CostReport struct {
+	Scheme string `json:"scheme"`
+
+	Offline_download float64 `json:"offline_download_kb"` // hint, downloaded once
+	Online_upload    float64 `json:"online_upload_kb"`    // per query
+	Online_download  float64 `json:"online_download_kb"`  // per query
+	Hint_size        float64 `json:"hint_size_kb"`        // stored by the client
+
+	Setup_ops  uint64 `json:"setup_ops"`  // server preprocessing, once per DB
+	Server_ops uint64 `json:"server_ops"` // server work to answer one query
+	Client_ops uint64 `json:"client_ops"` // client work to build one query and recover the answer
+
+	Server_memory float64 `json:"server_memory_kb"` // packed DB + server and shared state
+	Client_memory float64 `json:"client_memory_kb"` // hint + shared state
+}
+
+// Returns the communication per query (in KB), when the client downloads the
+// hint once and then makes num_queries queries.
+func (c *CostReport) Amortized(num_queries uint64) float64 {
+	return c.Offline_download/float64(num_queries) + c.Online_upload + c.Online_download
+}
+
+func (c *CostReport) Print() {
+	fmt.Printf("\t\tOffline download: %d KB\n", uint64(c.Offline_download))
+	fmt.Printf("\t\tOnline upload: %d KB\n", uint64(c.Online_upload))
+	fmt.Printf("\t\tOnline download: %d KB\n", uint64(c.Online_download))
+}
+
+// Measured throughput and communication of a run of a scheme's online phase,
+// as by RunFakePIR. Communication is in KB.
+type RunReport struct {
+	Scheme string `json:"scheme"`
+
+	Throughput float64 `json:"throughput_mb_s"` // MB of DB scanned per second while answering
+
+	Offline_download float64 `json:"offline_download_kb"`
+	Online_upload    float64 `json:"online_upload_kb"`
+	Online_download  float64 `json:"online_download_kb"`
+}
+
+// Returns the online communication, upload plus download.
+func (r *RunReport) Online() float64 {
+	return r.Online_upload + r.Online_download
+}
+
+// Returns the total communication, offline and online.
+func (r *RunReport) Total() float64 {
+	return r.Offline_download + r.Online()
+}
+
+// Returns the size (in KB) of num_elems elements of bits_per_elem bits each.
+func kbytes(num_elems, bits_per_elem uint64) float64 {
+	return float64(num_elems*bits_per_elem) / (8.0 * 1024.0)
+}
@@ -1,7 +1,7 @@
 package pir
 
+import "context"
 import "math"
-import "fmt"
 
 type DBinfo struct {
 	Num        uint64 // number of DB entries.
@@ -22,6 +22,25 @@ type DBinfo struct {
 	Cols      uint64
 }
 
+// Shape of the database, and the costs that a PIR scheme incurs on a
+// database of this shape.
+type DBShape struct {
+	L uint64 // DB height
+	M uint64 // DB width
+	X uint64 // DoublePIR's repetition param (see DBinfo)
+
+	Cost CostReport
+}
+
+// Returns the index of the Z_p elem (in row-major order, before stacking the
+// Ne elems of each entry) that holds DB entry i.
+func (info *DBinfo) elemIndex(i uint64) uint64 {
+	if info.Packing > 0 {
+		return i / info.Packing
+	}
+	return i
+}
+
 type Database struct {
 	Info DBinfo
 	Data *Matrix
@@ -151,8 +170,8 @@ func SetupDB(Num, row_length uint64, p *Params) *Database {
 	D.Info.Basis = 0
 	D.Info.Squishing = 0
 
-	fmt.Printf("Total packed DB size is ~%f MB\n",
-		float64(p.L*p.M)*math.Log2(float64(p.P))/(1024.0*1024.0*8.0))
+	logger.Info("packed DB",
+		"size_mb", float64(p.L*p.M)*math.Log2(float64(p.P))/(1024.0*1024.0*8.0))
 
 	if db_elems > p.L*p.M {
 		panic("Params and database size don't match")
@@ -166,16 +185,39 @@ func SetupDB(Num, row_length uint64, p *Params) *Database {
 }
 
 func MakeRandomDB(Num, row_length uint64, p *Params) *Database {
+	D, _ := MakeRandomDBCtx(context.Background(), Num, row_length, p)
+	return D
+}
+
+// Like MakeRandomDB, but gives up and returns ctx's error if ctx is done
+// before the database is filled in.
+func MakeRandomDBCtx(ctx context.Context, Num, row_length uint64, p *Params) (*Database, error) {
 	D := SetupDB(Num, row_length, p)
-	D.Data = MatrixRand(p.L, p.M, 0, p.P)
+	D.Data = MatrixNew(p.L, p.M)
+
+	// Sample the DB in blocks of rows (in the same order as MatrixRand would)
+	for off := uint64(0); off < p.L; off += ctxRowBlock {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rows := D.Data.SelectRows(off, ctxRowBlock)
+		copy(rows.Data, MatrixRand(rows.Rows, p.M, 0, p.P).Data)
+	}
 
 	// Map DB elems to [-p/2; p/2]
 	D.Data.Sub(p.P / 2)
 
-	return D
+	return D, nil
 }
 
 func MakeDB(Num, row_length uint64, p *Params, vals []uint64) *Database {
+	D, _ := MakeDBCtx(context.Background(), Num, row_length, p, vals)
+	return D
+}
+
+// Like MakeDB, but gives up and returns ctx's error if ctx is done before all
+// of vals are packed into the database.
+func MakeDBCtx(ctx context.Context, Num, row_length uint64, p *Params, vals []uint64) (*Database, error) {
 	D := SetupDB(Num, row_length, p)
 	D.Data = MatrixZeros(p.L, p.M)
 
@@ -183,12 +225,20 @@ func MakeDB(Num, row_length uint64, p *Params, vals []uint64) *Database {
 		panic("Bad input DB")
 	}
 
+	// check for cancellation about once per ctxRowBlock rows of the DB
+	check_every := int(ctxRowBlock * p.M)
+
 	if D.Info.Packing > 0 {
 		// Pack multiple DB elems into each Z_p elem
 		at := uint64(0)
 		cur := uint64(0)
 		coeff := uint64(1)
 		for i, elem := range vals {
+			if i%check_every == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
 			cur += (elem * coeff)
 			coeff *= (1 << row_length)
 			if ((i+1)%int(D.Info.Packing) == 0) || (i == len(vals)-1) {
@@ -201,6 +251,11 @@ func MakeDB(Num, row_length uint64, p *Params, vals []uint64) *Database {
 	} else {
 		// Use multiple Z_p elems to represent each DB elem
 		for i, elem := range vals {
+			if i%check_every == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
 			for j := uint64(0); j < D.Info.Ne; j++ {
 				D.Data.Set(Base_p(D.Info.P, elem, j), (uint64(i)/p.M)*D.Info.Ne+j, uint64(i)%p.M)
 			}
@@ -210,5 +265,65 @@ func MakeDB(Num, row_length uint64, p *Params, vals []uint64) *Database {
 	// Map DB elems to [-p/2; p/2]
 	D.Data.Sub(p.P / 2)
 
-	return D
+	return D, nil
+}
+
+// Find smallest l such that l*m >= N*ne and ne divides l, where ne is the
+// number of Z_p elements per DB entry determined by row_length and p.
+func DatabaseHeightGivenWidth(N, row_length, p, m uint64) uint64 {
+	db_elems, elems_per_entry, _ := Num_DB_entries(N, row_length, p)
+	l := uint64(math.Ceil(float64(db_elems) / float64(m)))
+
+	rem := l % elems_per_entry
+	if rem != 0 {
+		l += elems_per_entry - rem
+	}
+
+	return l
+}
+
+// Returns the DB width in [1, max_m] that minimizes cost. To keep the search
+// cheap, it first scans powers of two and widths spaced geometrically (by a
+// factor of ~1.01), and then scans all widths close to the best one found.
+func searchDatabaseWidth(max_m uint64, cost func(m uint64) float64) uint64 {
+	if max_m == 0 {
+		panic("No suitable params known!")
+	}
+
+	best_m := uint64(0)
+	best := math.Inf(1)
+	try := func(m uint64) {
+		if c := cost(m); c < best {
+			best = c
+			best_m = m
+		}
+	}
+
+	for m := uint64(1); m <= max_m; {
+		try(m)
+		next := uint64(float64(m) * 1.01)
+		if next <= m {
+			next = m + 1
+		}
+		m = next
+	}
+	for m := uint64(1); m <= max_m; m *= 2 {
+		try(m)
+	}
+	try(max_m)
+
+	if best_m == 0 {
+		panic("No suitable params known!")
+	}
+
+	lo := uint64(float64(best_m) / 1.01)
+	hi := uint64(float64(best_m)*1.01) + 1
+	if hi > max_m {
+		hi = max_m
+	}
+	for m := lo + 1; m <= hi; m++ {
+		try(m)
+	}
+
+	return best_m
 }
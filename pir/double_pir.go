@@ -3,16 +3,28 @@ package pir
 // #cgo CFLAGS: -O3 -march=native
 // #include "pir.h"
 import "C"
+import "context"
 import "fmt"
+import "math"
+import "time"
+
+// DoublePIR compresses the hint H1 = DB * A1 of SimplePIR with a second layer
+// of LWE. Raw_hint_cols tunes how much of it: the last Raw_hint_cols of its
+// N columns are sent as is, and only the others compressed, which trades a
+// larger hint for a smaller answer. It ranges from 0 (all of H1 is
+// compressed) to N (none is, and the hint is as large as SimplePIR's). A raw
+// column takes L elems of the hint and a compressed one delta*X*N, so raw
+// columns only cost hint size on DBs taller than that, as large DBs are.
+type DoublePIR struct {
+	Raw_hint_cols uint64
+}
 
-type DoublePIR struct{}
-
-// Offline download: matrix H2
+// Offline download: matrix H2 (and the raw columns of H1)
 // Online query: matrices q1, q2
 // Online download: matrices h1, a2, h2
 
 // Server state: matrix H1
-// Client state: matrices secret1, secret2
+// Client state: matrices secret1, secret2 (and, if streamed, the column sums of A2)
 // Shared state: matrices A1, A2
 
 // Ratio between first-level DB and second-level DB
@@ -23,35 +35,31 @@ func (pi *DoublePIR) Name() string {
 }
 
 func (pi *DoublePIR) PickParams(N, d, n, logq uint64) Params {
+	p := pi.pickParams(N, d, n, logq)
+	p.PrintParams()
+	return p
+}
+
+// Like PickParams, but does not print the params.
+func (pi *DoublePIR) pickParams(N, d, n, logq uint64) Params {
 	good_p := Params{}
 	found := false
 
 	// Iteratively refine p and DB dims, until find tight values
 	for mod_p := uint64(2); ; mod_p += 1 {
 		l, m := ApproxDatabaseDims(N, d, mod_p, COMP_RATIO*n)
-
-		p := Params{
-			N:    n,
-			Logq: logq,
-			L:    l,
-			M:    m,
-		}
-		p.PickParams(true, l, m)
+		p := pi.PickParamsGivenDimensions(l, m, n, logq)
 
 		if p.P < mod_p {
 			if !found {
 				panic("Error; should not happen")
 			}
-			good_p.PrintParams()
 			return good_p
 		}
 
 		good_p = p
 		found = true
 	}
-
-	panic("Cannot be reached")
-	return Params{}
 }
 
 func (pi *DoublePIR) PickParamsGivenDimensions(l, m, n, logq uint64) Params {
@@ -65,15 +73,115 @@ func (pi *DoublePIR) PickParamsGivenDimensions(l, m, n, logq uint64) Params {
         return p
 }
 
-func (pi *DoublePIR) GetBW(info DBinfo, p Params) {
-	offline_download := float64(p.delta()*info.X*p.N*p.N*p.Logq) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOffline download: %d KB\n", uint64(offline_download))
+// Like SimplePIR's ConcatDBs. The combined DB is taller than each of DBs, so
+// it needs params picked for more LWE samples.
+func (pi *DoublePIR) ConcatDBs(DBs []*Database, p Params) (*Database, Params, *TableMap, error) {
+	return concatDBs(DBs, p, pi.pickParams)
+}
+
+// Picks the DB dimensions (and the value of X, which the caller should set in
+// DBinfo) that minimize communication per query, when the client makes
+// num_queries queries for each hint download.
+func (pi *DoublePIR) PickParamsForQueries(N, d, n, logq, num_queries uint64) (Params, DBShape) {
+	if num_queries == 0 {
+		panic("Need at least one query")
+	}
+
+	max_samples := maxNumSamples(n, logq)
+	shape := func(m uint64) (Params, DBShape, bool) {
+		p := Params{
+			N:    n,
+			Logq: logq,
+			M:    m,
+		}
+		p.PickParams(true, m)
+
+		// The DB height depends on p, which in turn depends on the DB height;
+		// iterate until both are stable (p only decreases, so this terminates).
+		for {
+			p.L = DatabaseHeightGivenWidth(N, d, p.P, m)
+			if p.L > max_samples {
+				return p, DBShape{}, false
+			}
+			mod_p := p.P
+			p.PickParams(true, p.L, p.M)
+			if p.P == mod_p {
+				break
+			}
+		}
 
-	online_upload := float64(p.M*p.Logq+info.Ne/info.X*p.L/info.X*p.Logq) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOnline upload: %d KB\n", uint64(online_upload))
+		_, ne, _ := Num_DB_entries(N, d, p.P)
+		best := DBShape{}
+		for x := uint64(1); x <= ne; x++ {
+			if ne%x != 0 {
+				continue
+			}
+			s := DBShape{L: p.L, M: p.M, X: x, Cost: pi.GetBW(DBinfo{Ne: ne, X: x}, p)}
+			if (best.X == 0) || (s.Cost.Amortized(num_queries) < best.Cost.Amortized(num_queries)) {
+				best = s
+			}
+		}
+		return p, best, true
+	}
 
-	online_download := float64(p.delta()*info.X*p.N*p.Logq+p.delta()*p.N*info.Ne*p.Logq+p.delta()*info.Ne*p.Logq) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOnline download: %d KB\n", uint64(online_download))
+	m := searchDatabaseWidth(max_samples, func(m uint64) float64 {
+		_, s, ok := shape(m)
+		if !ok {
+			return math.Inf(1)
+		}
+		return s.Cost.Amortized(num_queries)
+	})
+
+	p, s, _ := shape(m)
+	p.PrintParams()
+	return p, s
+}
+
+func (pi *DoublePIR) GetBW(info DBinfo, p Params) CostReport {
+	d := p.delta()
+	a2_rows := p.L / info.X
+	c := pi.compressedCols(p)
+	raw := p.L * (p.N - c)
+
+	return CostReport{
+		Scheme: pi.Name(),
+
+		Offline_download: kbytes(d*info.X*c*p.N+raw, p.Logq),
+		Online_upload:    kbytes(p.M+info.Ne/info.X*p.L/info.X, p.Logq),
+		Online_download:  kbytes(d*info.X*p.N, p.Logq) + kbytes(d*c*info.Ne+d*info.Ne, p.answerLogq()),
+		Hint_size:        kbytes(d*info.X*c*p.N+raw, p.Logq),
+
+		// H1 = DB * A1, then H2 = H1 * A2 for its compressed columns
+		Setup_ops: p.L*p.M*p.N + d*c*p.L*p.N,
+
+		// a1 = DB * q1 and h1 = a1 * A2, then a2 = H1 * q2 and h2 = a1 * q2 for each q2
+		Server_ops: p.L*p.M + d*p.L*p.N + info.Ne/info.X*(d*c*p.L+d*p.L),
+
+		// A1 * secret1 and A2 * secret2 for each q2, then the corrections
+		// for A2 and decryption of each of the Ne recovered Z_p elems
+		Client_ops: p.M*p.N + info.Ne/info.X*a2_rows*p.N + a2_rows*p.N +
+			info.Ne*((c+1)*d*p.N+p.N),
+
+		// the DB and H1 are squished to 3 Z_p elems per Elem; A1 and A2 are shared
+		Server_memory: kbytes(p.L*((p.M+2)/3)+d*c*info.X*((a2_rows+2)/3)+
+			p.N*a2_rows+p.M*p.N+a2_rows*p.N, 32),
+		Client_memory: kbytes(d*info.X*c*p.N+raw+p.M*p.N+a2_rows*p.N, 32),
+	}
+}
+
+// Returns the number of columns of H1 that the second layer compresses.
+func (pi *DoublePIR) compressedCols(p Params) uint64 {
+	if pi.Raw_hint_cols > p.N {
+		panic("More raw hint columns than the hint has")
+	}
+	return p.N - pi.Raw_hint_cols
+}
+
+// Sets p.Logq_answer to the smallest modulus that answers can be switched to
+// without noticeably raising the probability of decryption failures in the
+// inner layer, which is decoded from the switched a2 and h2.
+func (pi *DoublePIR) PickAnswerModulus(p *Params, info DBinfo) {
+	p.Logq_answer = pickAnswerLogq(*p, noiseBound(*p, p.L/info.X))
 }
 
 func (pi *DoublePIR) Init(info DBinfo, p Params) State {
@@ -89,25 +197,94 @@ func (pi *DoublePIR) InitCompressed(info DBinfo, p Params) (State, CompressedSta
 }
 
 func (pi *DoublePIR) InitCompressedSeeded(info DBinfo, p Params, seed *PRGKey) (State, CompressedState) {
-        bufPrgReader = NewBufPRG(NewPRG(seed))
-        return pi.Init(info, p), MakeCompressedState(seed)
+	return pi.InitCompressedSeededPRG(info, p, seed, AESCTR)
+}
+
+// Like InitCompressedSeeded, but expands seed with the given kind of PRG.
+func (pi *DoublePIR) InitCompressedSeededPRG(info DBinfo, p Params, seed *PRGKey, kind PRGKind) (State, CompressedState) {
+	comp := MakeCompressedState(seed)
+	comp.PRG = kind
+	return pi.DecompressState(info, p, comp), comp
 }
 
+// Expands A1 and A2 from the seed with a PRG of their own, as SimplePIR does.
 func (pi *DoublePIR) DecompressState(info DBinfo, p Params, comp CompressedState) State {
-        bufPrgReader = NewBufPRG(NewPRG(comp.Seed))
-        return pi.Init(info, p)
+	s := newSeedStream(comp, p)
+	A1 := s.next(p.M, p.N)
+	A2 := s.next(p.L/info.X, p.N)
+	return MakeState(A1, A2)
 }
 
 func (pi *DoublePIR) Setup(DB *Database, shared State, p Params) (State, Msg) {
+	server, hint, _ := pi.SetupCtx(context.Background(), DB, shared, p)
+	return server, hint
+}
+
+// Like Setup, but gives up (leaving DB unmodified) and returns ctx's error if
+// ctx is done before the hint is computed.
+func (pi *DoublePIR) SetupCtx(ctx context.Context, DB *Database, shared State, p Params) (State, Msg, error) {
+	defer observeSince(MetricSetupSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricSetups, 1, "scheme", pi.Name())
+
 	A1 := shared.Data[0]
 	A2 := shared.Data[1]
 
-	H1 := MatrixMul(DB.Data, A1)
-	H1.Transpose()
-	H1.Expand(p.P, p.delta())
-	H1.ConcatCols(DB.Info.X)
+	H1, err := MatrixMulCtx(ctx, DB.Data, A1)
+	if err != nil {
+		return State{}, Msg{}, err
+	}
+	return pi.setupFromH1(ctx, DB, H1, A2, p)
+}
+
+// Like Setup, but regenerates A1 from comp's seed as it goes, rather than
+// reading it from a materialized shared state. (The server still holds A2,
+// which Answer needs.)
+func (pi *DoublePIR) SetupStreamed(DB *Database, comp CompressedState, p Params) (State, Msg) {
+	server, hint, _ := pi.SetupStreamedCtx(context.Background(), DB, comp, p)
+	return server, hint
+}
+
+// Like SetupCtx, but regenerates A1 from comp's seed as it goes.
+func (pi *DoublePIR) SetupStreamedCtx(ctx context.Context, DB *Database, comp CompressedState,
+	p Params) (State, Msg, error) {
+	defer observeSince(MetricSetupSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricSetups, 1, "scheme", pi.Name())
+
+	stream := newSeedStream(comp, p)
+	H1, err := stream.mulLeftCtx(ctx, DB.Data, p.M, p.N)
+	if err != nil {
+		return State{}, Msg{}, err
+	}
+	A2 := stream.next(p.L/DB.Info.X, p.N)
+	return pi.setupFromH1(ctx, DB, H1, A2, p)
+}
+
+// Finishes the setup, given H1 = DB * A1.
+func (pi *DoublePIR) setupFromH1(ctx context.Context, DB *Database, H1 *Matrix, A2 *Matrix,
+	p Params) (State, Msg, error) {
+	c := pi.compressedCols(p)
+	var raw *Matrix
+	if c < p.N {
+		raw = H1.ColsDeepCopy(c, p.N-c)
+		H1 = H1.ColsDeepCopy(0, c)
+	}
+
+	var H2 *Matrix
+	if c > 0 {
+		H1.Transpose()
+		H1.Expand(p.P, p.delta())
+		H1.ConcatCols(DB.Info.X)
 
-	H2 := MatrixMul(H1, A2)
+		var err error
+		H2, err = MatrixMulCtx(ctx, H1, A2)
+		if err != nil {
+			return State{}, Msg{}, err
+		}
+	} else {
+		// nothing is left for the second layer to compress
+		H1 = MatrixZeros(0, p.L/DB.Info.X)
+		H2 = MatrixZeros(0, p.N)
+	}
 
 	// pack the database more tightly, because the online computation is memory-bound
 	DB.Data.Add(p.P / 2)
@@ -122,14 +299,17 @@ func (pi *DoublePIR) Setup(DB *Database, shared State, p Params) (State, Msg) {
         }
 	A2_copy.Transpose()
 
-	return MakeState(H1, A2_copy), MakeMsg(H2)
+	hint := MakeMsg(H2)
+	if raw != nil {
+		hint.Data = append(hint.Data, raw)
+	}
+	return MakeState(H1, A2_copy), hint, nil
 }
 
-func (pi *DoublePIR) FakeSetup(DB *Database, p Params) (State, float64) {
+func (pi *DoublePIR) FakeSetup(DB *Database, p Params) State {
 	info := DB.Info
-	H1 := MatrixRand(p.N*p.delta()*info.X, p.L/info.X, 0, p.P)
-	offline_download := float64(p.N*p.delta()*info.X*p.N*uint64(p.Logq)) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOffline download: %d KB\n", uint64(offline_download))
+	c := pi.compressedCols(p)
+	H1 := MatrixRand(c*p.delta()*info.X, p.L/info.X, 0, p.P)
 
 	// pack the database more tightly, because the online computation is memory-bound
 	DB.Data.Add(p.P / 2)
@@ -144,19 +324,55 @@ func (pi *DoublePIR) FakeSetup(DB *Database, p Params) (State, float64) {
 	}
 	A2_copy := MatrixRand(p.N, A2_rows, p.Logq, 0)
 
-	return MakeState(H1, A2_copy), offline_download
+	return MakeState(H1, A2_copy)
 }
 
 func (pi *DoublePIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg) {
-	i1 := (i / p.M) * (info.Ne / info.X)
-	i2 := i % p.M
-
 	A1 := shared.Data[0]
 	A2 := shared.Data[1]
+	state, msg := pi.query(i, p, info, func(secret1, secrets2 *Matrix) (*Matrix, *Matrix) {
+		return MatrixMul(A1, secret1), MatrixMul(A2, secrets2)
+	})
+	return state, msg
+}
+
+// Like Query, but regenerates A1 and A2 from comp's seed as it goes, so that
+// the client never holds them in memory. Recover the answer with
+// RecoverStreamed, which reads the column sums of A2 that this computes along
+// the way from the returned client state, rather than A2 itself.
+func (pi *DoublePIR) QueryStreamed(i uint64, comp CompressedState, p Params, info DBinfo) (State, Msg) {
+	var A2_sums *Matrix
+	state, msg := pi.query(i, p, info, func(secret1, secrets2 *Matrix) (*Matrix, *Matrix) {
+		stream := newSeedStream(comp, p)
+		query1 := stream.mulRight(p.M, p.N, secret1)
+
+		query2 := MatrixNew(p.L/info.X, secrets2.Cols)
+		A2_sums = MatrixZeros(1, p.N)
+		stream.forEachBlock(context.Background(), p.L/info.X, p.N, func(off uint64, block *Matrix) {
+			copy(query2.Data[off*secrets2.Cols:], MatrixMul(block, secrets2).Data)
+			A2_sums.MatrixAdd(block.ColumnSums())
+		})
+		return query1, query2
+	})
+
+	state.Data = append(state.Data, A2_sums)
+	return state, msg
+}
+
+// Builds a query for index i, where mulA returns A1 * secret1 and A2 * secrets2
+// (whose columns are the secrets of the Ne/X queries q2).
+func (pi *DoublePIR) query(i uint64, p Params, info DBinfo,
+	mulA func(secret1, secrets2 *Matrix) (*Matrix, *Matrix)) (State, Msg) {
+	defer observeSince(MetricQuerySeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricQueriesBuilt, 1, "scheme", pi.Name())
+
+	i1 := (info.elemIndex(i) / p.M) * (info.Ne / info.X)
+	i2 := info.elemIndex(i) % p.M
 
 	secret1 := MatrixRand(p.N, 1, p.Logq, 0)
+	secrets2 := MatrixRand(p.N, info.Ne/info.X, p.Logq, 0)
 	err1 := MatrixGaussian(p.M, 1)
-	query1 := MatrixMul(A1, secret1)
+	query1, queries2 := mulA(secret1, secrets2)
 	query1.MatrixAdd(err1)
 	query1.Data[i2] += C.Elem(p.Delta())
 
@@ -168,9 +384,9 @@ func (pi *DoublePIR) Query(i uint64, shared State, p Params, info DBinfo) (State
 	msg := MakeMsg(query1)
 
 	for j := uint64(0); j < info.Ne/info.X; j++ {
-		secret2 := MatrixRand(p.N, 1, p.Logq, 0)
+		secret2 := secrets2.SelectColumn(j)
 		err2 := MatrixGaussian(p.L/info.X, 1)
-		query2 := MatrixMul(A2, secret2)
+		query2 := queries2.SelectColumn(j)
 		query2.MatrixAdd(err2)
 		query2.Data[i1+j] += C.Elem(p.Delta())
 
@@ -185,22 +401,67 @@ func (pi *DoublePIR) Query(i uint64, shared State, p Params, info DBinfo) (State
 	return state, msg
 }
 
+// Checks that query has the shape of a query built by Query: q1, followed by
+// Ne/X vectors q2.
+func (pi *DoublePIR) CheckQuery(query Msg, p Params, info DBinfo) error {
+	if info.X == 0 || uint64(len(query.Data)) != 1+info.Ne/info.X {
+		return fmt.Errorf("%w: got %d matrices, want %d", ErrMalformedQuery, len(query.Data), 1+info.Ne/info.X)
+	}
+	if err := checkQueryVector(query.Data[0], p.M, info.Squishing, p.Logq); err != nil {
+		return fmt.Errorf("%w: q1: %v", ErrMalformedQuery, err)
+	}
+	for j := uint64(1); j < uint64(len(query.Data)); j++ {
+		if err := checkQueryVector(query.Data[j], p.L/info.X, info.Squishing, p.Logq); err != nil {
+			return fmt.Errorf("%w: q2: %v", ErrMalformedQuery, err)
+		}
+	}
+	return nil
+}
+
 func (pi *DoublePIR) Answer(DB *Database, query MsgSlice, server State, shared State, p Params) Msg {
+	ans, err := pi.AnswerCtx(context.Background(), DB, query, server, shared, p)
+	if err != nil {
+		panic(err)
+	}
+	return ans
+}
+
+// Like Answer, but returns an error instead of panicking on malformed queries,
+// and gives up and returns ctx's error if ctx is done before the answer is
+// computed.
+func (pi *DoublePIR) AnswerCtx(ctx context.Context, DB *Database, query MsgSlice, server State, shared State,
+	p Params) (Msg, error) {
 	H1 := server.Data[0]
 	A2_transpose := server.Data[1]
 
 	a1 := new(Matrix)
 	num_queries := uint64(len(query.Data))
+	if err := checkBatchSize(num_queries, DB.Data.Rows, DB.Info); err != nil {
+		return Msg{}, err
+	}
+	for _, q := range query.Data {
+		if err := pi.CheckQuery(q, p, DB.Info); err != nil {
+			return Msg{}, err
+		}
+	}
 	batch_sz := DB.Data.Rows / num_queries
 
+	// the batch scans the DB once, then H1 and a1 once per q2
+	defer observeSince(MetricAnswerSeconds, pi.Name(), time.Now())
+	metrics.Observe(MetricAnswerBatchSize, float64(num_queries), "scheme", pi.Name())
+	scanned := matrixBytes(DB.Data)
+
 	last := uint64(0)
 	for batch, q := range query.Data {
 		q1 := q.Data[0]
 		if batch == int(num_queries-1) {
 			batch_sz = DB.Data.Rows - last
 		}
-		a := MatrixMulVecPacked(DB.Data.SelectRows(last, batch_sz),
+		a, err := MatrixMulVecPackedCtx(ctx, DB.Data.SelectRows(last, batch_sz),
 			                q1, DB.Info.Basis, DB.Info.Squishing)
+		if err != nil {
+			return Msg{}, err
+		}
 		a1.Concat(a)
 		last += batch_sz
 	}
@@ -212,23 +473,94 @@ func (pi *DoublePIR) Answer(DB *Database, query MsgSlice, server State, shared S
 	for _, q := range query.Data {
 		for j := uint64(0); j < DB.Info.Ne/DB.Info.X; j++ {
 			q2 := q.Data[1+j]
-			a2 := MatrixMulVecPacked(H1, q2, 10, 3)
+			a2, err := MatrixMulVecPackedCtx(ctx, H1, q2, 10, 3)
+			if err != nil {
+				return Msg{}, err
+			}
 			h2 := MatrixMulVecPacked(a1, q2, 10, 3)
+			scanned += matrixBytes(H1) + matrixBytes(a1)
 
-			msg.Data = append(msg.Data, a2)
-			msg.Data = append(msg.Data, h2)
+			// h1 is not switched, as the client multiplies it by secret2
+			msg.Data = append(msg.Data, switchAnswer(a2, p))
+			msg.Data = append(msg.Data, switchAnswer(h2, p))
 		}
 	}
+	metrics.AddCounter(MetricBytesScanned, float64(scanned), "scheme", pi.Name())
+	metrics.AddCounter(MetricQueriesAnswered, float64(num_queries), "scheme", pi.Name())
 
-	return msg
+	return msg, nil
+}
+
+// Checks that answer has the shape of an answer to a batch of num_queries
+// queries: h1, followed by a pair (a2, h2) per q2 of each query. Clients should
+// call this before Recover.
+func (pi *DoublePIR) CheckAnswer(answer Msg, num_queries uint64, p Params, info DBinfo) error {
+	if info.X == 0 {
+		return fmt.Errorf("%w: bad DBinfo", ErrMalformedAnswer)
+	}
+	want := 1 + 2*num_queries*(info.Ne/info.X)
+	if uint64(len(answer.Data)) != want {
+		return fmt.Errorf("%w: got %d matrices, want %d", ErrMalformedAnswer, len(answer.Data), want)
+	}
+
+	rows := p.delta() * info.X
+	if err := checkMatrix(answer.Data[0], rows, p.N, p.Logq); err != nil {
+		return fmt.Errorf("%w: h1: %v", ErrMalformedAnswer, err)
+	}
+	for j := uint64(1); j < want; j += 2 {
+		if err := checkAnswerVector(answer.Data[j], pi.compressedCols(p)*rows, p); err != nil {
+			return fmt.Errorf("%w: a2: %v", ErrMalformedAnswer, err)
+		}
+		if err := checkAnswerVector(answer.Data[j+1], rows, p); err != nil {
+			return fmt.Errorf("%w: h2: %v", ErrMalformedAnswer, err)
+		}
+	}
+	return nil
 }
 
 func (pi *DoublePIR) Recover(i uint64, batch_index uint64, offline Msg, query Msg,
 	answer Msg, shared State, client State, p Params, info DBinfo) uint64 {
+	val, _ := pi.RecoverNoise(i, batch_index, offline, query, answer, shared, client, p, info)
+	return val
+}
+
+// Like Recover, but also reports the noise in each decoded Z_p elem (of both
+// the inner and the outer layer), to detect probable decryption failures.
+func (pi *DoublePIR) RecoverNoise(i uint64, batch_index uint64, offline Msg, query Msg,
+	answer Msg, shared State, client State, p Params, info DBinfo) (uint64, *NoiseReport) {
+	A2 := shared.Data[1]
+	if A2.Cols != p.N {
+		panic("Should not happen!")
+	}
+	return pi.recoverNoise(i, batch_index, offline, query, answer, A2.ColumnSums(), client, p, info)
+}
+
+// Like Recover, for a query built by QueryStreamed.
+func (pi *DoublePIR) RecoverStreamed(i uint64, batch_index uint64, offline Msg, query Msg,
+	answer Msg, client State, p Params, info DBinfo) uint64 {
+	A2_sums := client.Data[1+info.Ne/info.X]
+	val, _ := pi.recoverNoise(i, batch_index, offline, query, answer, A2_sums, client, p, info)
+	return val
+}
+
+// Recovers the record, given the column sums of A2.
+func (pi *DoublePIR) recoverNoise(i uint64, batch_index uint64, offline Msg, query Msg,
+	answer Msg, A2_sums *Matrix, client State, p Params, info DBinfo) (uint64, *NoiseReport) {
+	defer observeSince(MetricRecoverSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricRecoveries, 1, "scheme", pi.Name())
+
 	H2 := offline.Data[0]
 	h1 := answer.Data[0].RowsDeepCopy(0, answer.Data[0].Rows) // deep copy whole matrix 
 	secret1 := client.Data[0]
 
+	// the raw columns of H1 multiply the last entries of secret1
+	c := pi.compressedCols(p)
+	var raw *Matrix
+	if c < p.N {
+		raw = offline.Data[1]
+	}
+	i1 := (info.elemIndex(i) / p.M) * (info.Ne / info.X)
+
 	ratio := p.P/2
 	val1 := uint64(0)
 	for j := uint64(0); j<p.M; j++ {
@@ -237,22 +569,11 @@ func (pi *DoublePIR) Recover(i uint64, batch_index uint64, offline Msg, query Ms
 	val1 %= (1<<p.Logq)
 	val1 = (1<<p.Logq)-val1
 
-	val2 := uint64(0)
-	for j := uint64(0); j<p.L/info.X; j++ {
-		val2 += ratio*query.Data[1].Get(j,0)
-	}
-	val2 %= (1<<p.Logq)
-	val2 = (1<<p.Logq)-val2
-
-	A2 := shared.Data[1]
-	if (A2.Cols != p.N) || (h1.Cols != p.N) {
+	if (A2_sums.Cols != p.N) || (h1.Cols != p.N) {
 		panic("Should not happen!")
 	}
 	for j1 := uint64(0); j1<p.N; j1++ {
-		val3 := uint64(0)
-	        for j2 := uint64(0); j2<A2.Rows; j2++ {
-			val3 += ratio*A2.Get(j2,j1)
-		}
+		val3 := ratio*A2_sums.Get(0,j1)
 		val3 %= (1<<p.Logq)
 		val3 = (1<<p.Logq)-val3
 		v := C.Elem(val3)
@@ -263,36 +584,61 @@ func (pi *DoublePIR) Recover(i uint64, batch_index uint64, offline Msg, query Ms
 
 	offset := (info.Ne / info.X * 2) * batch_index // for batching
 	var vals []uint64
+	report := newNoiseReport(p)
 	for i := uint64(0); i < info.Ne/info.X; i++ {
-		a2 := answer.Data[1+2*i+offset]
-		h2 := answer.Data[2+2*i+offset]
+		a2 := unswitchAnswer(answer.Data[1+2*i+offset], c*p.delta()*info.X, p)
+		h2 := unswitchAnswer(answer.Data[2+2*i+offset], p.delta()*info.X, p)
 		secret2 := client.Data[1+i]
+
+		// each q2 needs its own correction, as Ne/X > 1 queries are made
+		val2 := uint64(0)
+		for j := uint64(0); j<p.L/info.X; j++ {
+			val2 += ratio*query.Data[1+i].Get(j,0)
+		}
+		val2 %= (1<<p.Logq)
+		val2 = (1<<p.Logq)-val2
 		h2.Add(val2)
 
 		for j := uint64(0); j < info.X; j++ {
-			state := a2.RowsDeepCopy(j*p.N*p.delta(), p.N*p.delta())
+			state := a2.RowsDeepCopy(j*c*p.delta(), c*p.delta())
 			state.Add(val2)
 			state.Concat(h2.SelectRows(j*p.delta(), p.delta()))
 
-			hint := H2.RowsDeepCopy(j*p.N*p.delta(), p.N*p.delta())
+			hint := H2.RowsDeepCopy(j*c*p.delta(), c*p.delta())
 			hint.Concat(h1.SelectRows(j*p.delta(), p.delta()))
 
 			interm := MatrixMul(hint, secret2)
 			state.MatrixSub(interm)
+			for _, v := range state.Data {
+				report.Inner = append(report.Inner, p.Noise(uint64(v)))
+			}
 			state.Round(p)
 			state.Contract(p.P, p.delta())
 
-			noised := uint64(state.Data[p.N]) + val1
-			for l := uint64(0); l < p.N; l++ {
+			noised := uint64(state.Data[c]) + val1
+			for l := uint64(0); l < c; l++ {
 				noised -= uint64(secret1.Data[l] * state.Data[l])
 				noised = noised % (1 << p.Logq)
 			}
+			if raw != nil {
+				// DB row (i1+i)*X + j is column i1+i of the j-th block of H1
+				row := (i1+i)*info.X + j
+				for l := c; l < p.N; l++ {
+					noised -= uint64(secret1.Data[l] * C.Elem(raw.Get(row, l-c)))
+					noised = noised % (1 << p.Logq)
+				}
+			}
 			vals = append(vals, p.Round(noised))
+			report.Noise = append(report.Noise, p.Noise(noised))
 			//fmt.Printf("Reconstructing row %d: %d\n", j+info.X*i, denoised)
 		}
 	}
 
-	return ReconstructElem(vals, i, info)
+	if report.ProbableFailure() {
+		logger.Warn("probable decryption failure", "scheme", pi.Name(), "index", i, "budget", report.Budget())
+	}
+
+	return ReconstructElem(vals, i, info), report
 }
 
 func (pi *DoublePIR) Reset(DB *Database, p Params) {
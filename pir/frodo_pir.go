@@ -0,0 +1,122 @@
+package pir
+
+import "time"
+
+// FrodoPIR-style variant of SimplePIR. The server side is SimplePIR's (and is
+// recorded as such in metrics): it publishes the seed of A (InitCompressed) and
+// the hint H = DB * A. The client, rather than using H at query time, derives
+// everything that depends on it offline: Preprocess samples the secrets of a
+// batch of future queries and computes their query vectors A * s + e (streaming
+// A from its seed) and their masks H * s, and returns them as a client State.
+// Online, QueryPreprocessed turns one of them into a query with a single
+// addition of Delta, and recovery is a subtraction and a rounding; after
+// preprocessing, the client can drop the hint.
+//
+// Query builds a SimplePIR query, as does QueryPreprocessed when no
+// preprocessed queries are left (streaming A from its seed, so the client never
+// holds A); Recover decodes those using the hint.
+
+type FrodoPIR struct {
+	SimplePIR
+}
+
+// Each preprocessed query takes this many matrices of the client State: its
+// secret (N x 1), its query vector A*s + e (padded to the compressed DB), and
+// its mask H*s.
+const frodoQueryMatrices = 3
+
+func (pi *FrodoPIR) Name() string {
+	return "FrodoPIR"
+}
+
+func (pi *FrodoPIR) GetBW(info DBinfo, p Params) CostReport {
+	c := pi.SimplePIR.GetBW(info, p)
+	c.Scheme = pi.Name()
+
+	// online: Delta into the query, then subtract the mask; offline, per
+	// query: A * secret and H * secret
+	c.Client_ops = p.M + p.L + p.M*p.N + p.L*p.N
+
+	// the hint (until preprocessing is done), and a single preprocessed query:
+	// its secret, query vector and mask. Each further preprocessed query takes
+	// as much again. A is streamed from its seed.
+	c.Client_memory = kbytes(p.L*p.N+p.N+p.M+p.L, 32)
+	return c
+}
+
+// Preprocesses num_queries queries, given the hint and the seed of A. Returns
+// them as a client State, for later calls to QueryPreprocessed; the client
+// must keep it secret, and must not share it with other clients.
+func (pi *FrodoPIR) Preprocess(offline Msg, comp CompressedState, p Params, info DBinfo, num_queries uint64) State {
+	if num_queries == 0 {
+		return MakeState()
+	}
+	H := offline.Data[0]
+
+	secrets := MatrixRand(p.N, num_queries, p.Logq, 0)
+	queries := newSeedStream(comp, p).mulRight(p.M, p.N, secrets)
+	masks := MatrixMul(H, secrets)
+
+	pre := MakeState()
+	for j := uint64(0); j < num_queries; j++ {
+		query := queries.SelectColumn(j)
+		query.MatrixAdd(MatrixGaussian(p.M, 1))
+		if p.M%info.Squishing != 0 {
+			query.AppendZeros(info.Squishing - (p.M % info.Squishing))
+		}
+		pre.Data = append(pre.Data, secrets.SelectColumn(j), query, masks.SelectColumn(j))
+	}
+	return pre
+}
+
+// Returns the number of preprocessed queries left in pre.
+func PendingFrodoQueries(pre State) int {
+	return len(pre.Data) / frodoQueryMatrices
+}
+
+// Builds a query for entry i from one of the preprocessed queries in pre, and
+// removes it from pre, so that it is never used twice. If pre holds none,
+// builds a SimplePIR query online instead, from the seed of A.
+func (pi *FrodoPIR) QueryPreprocessed(i uint64, pre *State, comp CompressedState, p Params,
+	info DBinfo) (State, Msg) {
+	n := len(pre.Data)
+	if n < frodoQueryMatrices {
+		logger.Debug("no preprocessed queries left; building query online", "scheme", pi.Name())
+		return pi.SimplePIR.QueryStreamed(i, comp, p, info)
+	}
+	secret, query, mask := pre.Data[n-3], pre.Data[n-2], pre.Data[n-1]
+	for j := n - frodoQueryMatrices; j < n; j++ {
+		pre.Data[j] = nil
+	}
+	pre.Data = pre.Data[:n-frodoQueryMatrices]
+
+	defer observeSince(MetricQuerySeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricQueriesBuilt, 1, "scheme", pi.Name())
+
+	query.AddAt(p.Delta(), info.elemIndex(i)%p.M, 0)
+	return MakeState(secret, mask), MakeMsg(query)
+}
+
+func (pi *FrodoPIR) Recover(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) uint64 {
+	val, _ := pi.RecoverNoise(i, batch_index, offline, query, answer, shared, client, p, info)
+	return val
+}
+
+// Like Recover, but also reports the noise in each decoded Z_p elem. Uses the
+// hint only for queries that were not preprocessed.
+func (pi *FrodoPIR) RecoverNoise(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) (uint64, *NoiseReport) {
+	defer observeSince(MetricRecoverSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricRecoveries, 1, "scheme", pi.Name())
+
+	if len(client.Data) < 2 {
+		return simpleDecode(pi.Name(), i, query, answer, MatrixMul(offline.Data[0], client.Data[0]), p, info)
+	}
+	return simpleDecode(pi.Name(), i, query, answer, client.Data[1], p, info)
+}
+
+func (pi *FrodoPIR) RecoverStreamed(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	client State, p Params, info DBinfo) uint64 {
+	return pi.Recover(i, batch_index, offline, query, answer, State{}, client, p, info)
+}
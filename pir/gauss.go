@@ -1,5 +1,10 @@
 package pir
 
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
 var cdf_table = [...]float64{
 	0.5, 0.987867, 0.952345, 0.895957, 0.822578, 0.736994, 0.644389, 0.549831, 0.457833, 0.372034,
 	0.295023, 0.22831, 0.172422, 0.127074, 0.0913938, 0.0641467, 0.0439369, 0.0293685, 0.0191572,
@@ -22,26 +27,57 @@ var cdf_table = [...]float64{
 	3.05465e-82, 1.46185e-83, 6.82713e-85, 3.11152e-86, 1.3839e-87,
 }
 
-// The function below is modeled on Martin Albrecht's discrete-Gaussian
-// sampler included in his dgs library:
-//    https://github.com/malb/dgs
-func GaussSample() int64 {
-	mrand := MathRand()
+// The table above gives rho(x) = exp(-x^2 / (2 * 6.4^2)), halved at x = 0 so
+// that a random sign can be applied to every sample. Normalized, it is the
+// distribution of |x|; cdt[k] = 2^63 * Pr[|x| > k], truncated once the tail
+// probability drops below 2^-63.
+var cdt = computeCDT()
 
-	var x int64
-	var y float64
-	for {
-		x = int64(mrand.Intn(len(cdf_table)))
-		y = mrand.Float64()
+func computeCDT() []uint64 {
+	// sum the tail from the end, so that small tail probabilities stay precise
+	tails := make([]float64, len(cdf_table))
+	for k := len(cdf_table) - 2; k >= 0; k-- {
+		tails[k] = tails[k+1] + cdf_table[k+1]
+	}
+	total := tails[0] + cdf_table[0]
 
-		if y < cdf_table[x] {
+	var out []uint64
+	for _, tail := range tails {
+		c := tail / total * (1 << 63)
+		if c < 1 {
 			break
 		}
+		out = append(out, uint64(c))
 	}
+	return out
+}
+
+// Fills out with samples from the discrete Gaussian, drawing all of the
+// randomness from the PRG at once. Each sample takes 63 random bits, which it
+// compares against every entry of cdt without branching (so the time taken
+// does not depend on the sample), and one more random bit for its sign.
+func GaussSampleVec(out []int64) {
+	buf := make([]byte, 8*len(out))
+	RandBytes(buf)
 
-	if mrand.Uint64()%2 == 0 {
-		x = -x
+	for i := range out {
+		u := binary.LittleEndian.Uint64(buf[8*i:])
+		r := u >> 1
+
+		x := int64(0)
+		for _, c := range cdt {
+			_, borrow := bits.Sub64(r, c, 0) // borrow = 1 iff r < c
+			x += int64(borrow)
+		}
+
+		// negate x iff the sign bit is set
+		mask := -int64(u & 1)
+		out[i] = (x ^ mask) - mask
 	}
+}
 
-	return x
+func GaussSample() int64 {
+	var out [1]int64
+	GaussSampleVec(out[:])
+	return out[0]
 }
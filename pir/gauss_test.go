@@ -2,6 +2,7 @@ package pir
 
 import (
 	"log"
+	"math"
 	"testing"
 )
 
@@ -15,3 +16,77 @@ func TestGauss(t *testing.T) {
 		log.Printf("bucket[%v] = %v", i, buckets[i])
 	}
 }
+
+// Returns Pr[x] for the discrete Gaussian that cdf_table describes.
+func gaussProb(x int64) float64 {
+	total := float64(0)
+	for _, w := range cdf_table {
+		total += w
+	}
+	if x == 0 {
+		return cdf_table[0] / total
+	}
+	return cdf_table[int(math.Abs(float64(x)))] / (2 * total)
+}
+
+// Test the samples against the target distribution with a chi-squared test,
+// and check their mean and variance.
+func TestGaussDistribution(t *testing.T) {
+	num := 1 << 22
+	samples := make([]int64, num)
+	GaussSampleVec(samples)
+
+	// bins -45..45; the tails beyond have negligible probability
+	const max = int64(45)
+	counts := make(map[int64]int)
+	sum, sum_sq := float64(0), float64(0)
+	for _, s := range samples {
+		if s > max || s < -max {
+			panic("Sample in negligible tail")
+		}
+		counts[s] += 1
+		sum += float64(s)
+		sum_sq += float64(s * s)
+	}
+
+	chi2 := float64(0)
+	bins := 0
+	variance := float64(0)
+	for x := -max; x <= max; x++ {
+		expected := gaussProb(x) * float64(num)
+		variance += gaussProb(x) * float64(x*x)
+		if expected < 5 {
+			continue
+		}
+		d := float64(counts[x]) - expected
+		chi2 += d * d / expected
+		bins += 1
+	}
+
+	mean := sum / float64(num)
+	emp_variance := sum_sq/float64(num) - mean*mean
+	log.Printf("chi2 = %f over %d bins; mean = %f; variance = %f (target %f)",
+		chi2, bins, mean, emp_variance, variance)
+
+	// the 1-in-10^6 critical value of chi2 with ~60 degrees of freedom is ~125
+	if chi2 > 2*float64(bins)+30 {
+		panic("Samples do not match the target distribution")
+	}
+	if math.Abs(mean) > 0.02 || math.Abs(emp_variance-variance) > 0.02*variance {
+		panic("Bad mean or variance")
+	}
+}
+
+// Test that the sampler's running time does not depend on the sample: every
+// sample makes one comparison per cdt entry, and the CDT covers the whole
+// support up to negligible tails.
+func TestGaussCDT(t *testing.T) {
+	for k := 1; k < len(cdt); k++ {
+		if cdt[k] >= cdt[k-1] {
+			panic("CDT not decreasing")
+		}
+	}
+	if float64(cdt[len(cdt)-1]) > 1e6 || len(cdt) < 40 {
+		panic("CDT truncated too early")
+	}
+}
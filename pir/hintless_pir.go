@@ -0,0 +1,422 @@
+package pir
+
+import "context"
+import "encoding/binary"
+import "fmt"
+import "time"
+
+import "github.com/ahenzinger/simplepir/ring"
+
+// Hintless variant of SimplePIR, in the style of HintlessPIR and YPIR: the
+// client downloads no hint. The LWE layer is SimplePIR's (and is recorded as
+// such in metrics); on top of it, the client sends its LWE secret s encrypted
+// under ring-LWE (rlwe.go, on package ring), and the server evaluates H * s homomorphically on
+// the hint H = DB * A that SimplePIR.Setup computes, returning it encrypted
+// along with the SimplePIR answer. The client decrypts the entries of H * s
+// that it needs, and decodes as in SimplePIR.
+//
+// The secret is packed hintlessLayout.w coefficients per ciphertext, spaced
+// n/w apart, and H is cut into windows of n/w rows: the product of a
+// ciphertext with the right plaintext polynomial holds the contribution of its
+// w secret coefficients to a window of H * s in its first n/w coefficients
+// (and garbage elsewhere). Packing more coefficients per ciphertext shrinks
+// the query but grows the answer; the layout picks the w that minimizes their
+// sum. H is split into hintlessDigits digits to keep the error of the products
+// small, and the client recombines the decrypted digits. Setup precomputes the
+// plaintext polynomials of every window, in NTT form, in place of the hint.
+//
+// A query is a Msg of the SimplePIR query, the seed of the random parts of the
+// ciphertexts (as a 1 x 4 matrix) and their bodies; the answer is a Msg of the
+// SimplePIR answer and, for each query in the batch, the random parts (in NTT
+// form) and the first n/w coefficients of the bodies of the encrypted windows.
+
+type HintlessPIR struct {
+	SimplePIR
+}
+
+const hintlessDigits = uint64(2)
+const hintlessDigitBits = uint64(16)
+
+type hintlessLayout struct {
+	w       uint64 // secret coefficients per ciphertext
+	groups  uint64 // ciphertexts per query
+	rows    uint64 // rows of H per window (n/w)
+	windows uint64 // number of windows
+}
+
+// Picks the packing that minimizes the (RNS) elems sent per query.
+func hintlessLayoutFor(p Params) hintlessLayout {
+	best := hintlessLayout{}
+	best_cost := uint64(0)
+	for w := uint64(1); w <= rlweN; w *= 2 {
+		l := hintlessLayout{
+			w:       w,
+			groups:  (p.N + w - 1) / w,
+			rows:    rlweN / w,
+			windows: (p.L + rlweN/w - 1) / (rlweN / w),
+		}
+		up, down := l.size()
+		if best.w == 0 || up+down < best_cost {
+			best = l
+			best_cost = up + down
+		}
+	}
+	return best
+}
+
+// Returns the number of RNS elems in the encrypted part of a query and of an
+// answer.
+func (l hintlessLayout) size() (uint64, uint64) {
+	up := l.groups * uint64(rlweNumModuli) * rlweN
+	down := l.windows * hintlessDigits * uint64(rlweNumModuli) * (rlweN + l.rows)
+	return up, down
+}
+
+// Returns digit d of the centered representative of h mod 2^32, in base
+// 2^hintlessDigitBits (with centered digits).
+func hintDigit(h uint64, d uint64) int64 {
+	v := int64(int32(uint32(h)))
+	for k := uint64(0); k < d; k++ {
+		lo := v << (64 - hintlessDigitBits) >> (64 - hintlessDigitBits)
+		v = (v - lo) >> hintlessDigitBits
+	}
+	if d == hintlessDigits-1 {
+		return v
+	}
+	return v << (64 - hintlessDigitBits) >> (64 - hintlessDigitBits)
+}
+
+func (pi *HintlessPIR) Name() string {
+	return "HintlessPIR"
+}
+
+func (pi *HintlessPIR) GetBW(info DBinfo, p Params) CostReport {
+	l := hintlessLayoutFor(p)
+	up, down := l.size()
+	polys := l.windows * l.groups * hintlessDigits // plaintext polynomials of H
+
+	c := pi.SimplePIR.GetBW(info, p)
+	c.Scheme = pi.Name()
+	c.Offline_download = 0
+	c.Hint_size = 0
+
+	// the seed of the ciphertexts, and residues below 2^31
+	c.Online_upload += kbytes(1, 128) + kbytes(up, 31)
+	c.Online_download += kbytes(down, 31)
+
+	c.Setup_ops += polys * uint64(rlweNumModuli) * rlweN * rlweLogN
+	c.Server_ops += 2 * polys * uint64(rlweNumModuli) * rlweN
+	c.Client_ops = p.M*p.N + l.groups*uint64(rlweNumModuli)*rlweN*rlweLogN
+
+	// the plaintext polynomials of H replace the hint
+	c.Server_memory += kbytes(polys*uint64(rlweNumModuli)*rlweN, 32)
+	c.Client_memory = kbytes(p.M*p.N, 32)
+	return c
+}
+
+func (pi *HintlessPIR) Setup(DB *Database, shared State, p Params) (State, Msg) {
+	server, hint, _ := pi.SetupCtx(context.Background(), DB, shared, p)
+	return server, hint
+}
+
+// Like Setup, but gives up and returns ctx's error if ctx is done before the
+// hint is computed.
+func (pi *HintlessPIR) SetupCtx(ctx context.Context, DB *Database, shared State, p Params) (State, Msg, error) {
+	_, hint, err := pi.SimplePIR.SetupCtx(ctx, DB, shared, p)
+	if err != nil {
+		return State{}, Msg{}, err
+	}
+	return MakeState(encodeHint(hint.Data[0], p)...), MakeMsg(), nil
+}
+
+func (pi *HintlessPIR) SetupStreamed(DB *Database, comp CompressedState, p Params) (State, Msg) {
+	_, hint := pi.SimplePIR.SetupStreamed(DB, comp, p)
+	return MakeState(encodeHint(hint.Data[0], p)...), MakeMsg()
+}
+
+func (pi *HintlessPIR) FakeSetup(DB *Database, p Params) State {
+	pi.SimplePIR.FakeSetup(DB, p)
+
+	l := hintlessLayoutFor(p)
+	var server State
+	for g := uint64(0); g < l.windows; g++ {
+		rows := l.groups * hintlessDigits * uint64(rlweNumModuli)
+		server.Data = append(server.Data, MatrixRand(rows, rlweN, 0, rlweModuli[1]))
+	}
+	return server
+}
+
+// Returns the plaintext polynomials of the hint H, in NTT form: for each
+// window, a matrix whose rows hold, for each ciphertext of the query and each
+// digit, the residues of the polynomial mod each prime.
+func encodeHint(H *Matrix, p Params) []*Matrix {
+	l := hintlessLayoutFor(p)
+	num_moduli := uint64(rlweNumModuli)
+
+	var out []*Matrix
+	for g := uint64(0); g < l.windows; g++ {
+		m := MatrixNew(l.groups*hintlessDigits*num_moduli, rlweN)
+		for k := uint64(0); k < l.groups; k++ {
+			for d := uint64(0); d < hintlessDigits; d++ {
+				// secret coefficient k*w+v sits at X^(v*rows) of the
+				// ciphertext, so its column of H goes at X^(-v*rows)
+				poly := rlweRing.NewPoly()
+				for v := uint64(0); v < l.w && k*l.w+v < p.N; v++ {
+					for r := uint64(0); r < l.rows && g*l.rows+r < p.L; r++ {
+						h := hintDigit(H.Get(g*l.rows+r, k*l.w+v), d)
+						if v == 0 {
+							rlweRing.SetCoeff(poly, r, h)
+						} else {
+							rlweRing.SetCoeff(poly, rlweN-v*l.rows+r, -h)
+						}
+					}
+				}
+				rlweRing.NTT(poly)
+				polyToRows(poly, m, (k*hintlessDigits+d)*num_moduli)
+			}
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func (pi *HintlessPIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg) {
+	client, query := pi.SimplePIR.Query(i, shared, p, info)
+	return pi.encryptSecret(client, query, p)
+}
+
+func (pi *HintlessPIR) QueryStreamed(i uint64, comp CompressedState, p Params, info DBinfo) (State, Msg) {
+	client, query := pi.SimplePIR.QueryStreamed(i, comp, p, info)
+	return pi.encryptSecret(client, query, p)
+}
+
+// Adds the RLWE encryption of the secret of a SimplePIR query to it; the RLWE
+// secret (in NTT form) joins the client state.
+func (pi *HintlessPIR) encryptSecret(client State, query Msg, p Params) (State, Msg) {
+	l := hintlessLayoutFor(p)
+	secret := client.Data[0]
+
+	z := rlweRing.TernaryPoly(randBytesReader{})
+	rlweRing.NTT(z)
+	key := RandomPRGKey()
+	read := rlweSeededReader(key)
+
+	bodies := MatrixNew(l.groups*uint64(rlweNumModuli), rlweN)
+	for k := uint64(0); k < l.groups; k++ {
+		msg := make([]uint64, rlweN)
+		for v := uint64(0); v < l.w && k*l.w+v < p.N; v++ {
+			msg[v*l.rows] = secret.Get(k*l.w+v, 0)
+		}
+		b := rlweEncrypt(z, rlweRing.UniformPoly(read), msg)
+		polyToRows(b, bodies, k*uint64(rlweNumModuli))
+	}
+
+	seed := MatrixNew(1, 4)
+	for j := uint64(0); j < 4; j++ {
+		seed.Set(uint64(binary.LittleEndian.Uint32(key[4*j:])), 0, j)
+	}
+
+	z_rows := MatrixNew(uint64(rlweNumModuli), rlweN)
+	polyToRows(z, z_rows, 0)
+
+	return MakeState(secret, z_rows), MakeMsg(query.Data[0], seed, bodies)
+}
+
+// Checks that query has the shape of a query built by Query.
+func (pi *HintlessPIR) CheckQuery(query Msg, p Params, info DBinfo) error {
+	if len(query.Data) != 3 {
+		return fmt.Errorf("%w: got %d matrices, want 3", ErrMalformedQuery, len(query.Data))
+	}
+	if err := pi.SimplePIR.CheckQuery(MakeMsg(query.Data[0]), p, info); err != nil {
+		return err
+	}
+	if err := checkMatrix(query.Data[1], 1, 4, 32); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedQuery, err)
+	}
+	l := hintlessLayoutFor(p)
+	if err := checkResidues(query.Data[2], l.groups, rlweN); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedQuery, err)
+	}
+	return nil
+}
+
+// Checks that m holds the residues of num polys polynomials of cols
+// coefficients each, mod each prime.
+func checkResidues(m *Matrix, num, cols uint64) error {
+	if err := checkMatrix(m, num*uint64(rlweNumModuli), cols, 32); err != nil {
+		return err
+	}
+	for r := uint64(0); r < m.Rows; r++ {
+		q := rlweModuli[r%uint64(rlweNumModuli)]
+		for c := uint64(0); c < cols; c++ {
+			if m.Get(r, c) >= q {
+				return fmt.Errorf("residue %d out of range", m.Get(r, c))
+			}
+		}
+	}
+	return nil
+}
+
+func (pi *HintlessPIR) Answer(DB *Database, query MsgSlice, server State, shared State, p Params) Msg {
+	ans, err := pi.AnswerCtx(context.Background(), DB, query, server, shared, p)
+	if err != nil {
+		panic(err)
+	}
+	return ans
+}
+
+// Like Answer, but returns an error instead of panicking on malformed queries,
+// and gives up and returns ctx's error if ctx is done before the answer is
+// computed.
+func (pi *HintlessPIR) AnswerCtx(ctx context.Context, DB *Database, query MsgSlice, server State, shared State,
+	p Params) (Msg, error) {
+	num_queries := uint64(len(query.Data))
+	if err := checkBatchSize(num_queries, DB.Data.Rows, DB.Info); err != nil {
+		return Msg{}, err
+	}
+	for _, q := range query.Data {
+		if err := pi.CheckQuery(q, p, DB.Info); err != nil {
+			return Msg{}, err
+		}
+	}
+
+	defer observeSince(MetricAnswerSeconds, pi.Name(), time.Now())
+	metrics.Observe(MetricAnswerBatchSize, float64(num_queries), "scheme", pi.Name())
+
+	// SimplePIR's answer, then the hint evaluated on the encrypted secret
+	ans, err := answerSlices(ctx, DB, query)
+	if err != nil {
+		return Msg{}, err
+	}
+	msg := MakeMsg(switchAnswer(ans, p))
+	for _, q := range query.Data {
+		randoms, bodies, err := evalHint(ctx, server, q.Data[1], q.Data[2], p)
+		if err != nil {
+			return Msg{}, err
+		}
+		msg.Data = append(msg.Data, randoms, bodies)
+	}
+
+	metrics.AddCounter(MetricBytesScanned, float64(matrixBytes(DB.Data)), "scheme", pi.Name())
+	metrics.AddCounter(MetricQueriesAnswered, float64(num_queries), "scheme", pi.Name())
+	return msg, nil
+}
+
+// Evaluates the plaintext polynomials of H on the ciphertexts of a query.
+// Returns, for each window and digit, the random part of the result (in NTT
+// form) and the first rows coefficients of its body.
+func evalHint(ctx context.Context, server State, seed *Matrix, bodies *Matrix, p Params) (*Matrix, *Matrix, error) {
+	l := hintlessLayoutFor(p)
+	num_moduli := uint64(rlweNumModuli)
+
+	var key PRGKey
+	for j := uint64(0); j < 4; j++ {
+		binary.LittleEndian.PutUint32(key[4*j:], uint32(seed.Get(0, j)))
+	}
+	read := rlweSeededReader(&key)
+
+	as := make([]*ring.Poly, l.groups)
+	bs := make([]*ring.Poly, l.groups)
+	for k := uint64(0); k < l.groups; k++ {
+		as[k] = rlweRing.UniformPoly(read)
+		rlweRing.NTT(as[k])
+		bs[k] = polyFromRows(bodies, k*num_moduli)
+		rlweRing.NTT(bs[k])
+	}
+
+	randoms := MatrixNew(l.windows*hintlessDigits*num_moduli, rlweN)
+	out := MatrixNew(l.windows*hintlessDigits*num_moduli, l.rows)
+	for g := uint64(0); g < l.windows; g++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		for d := uint64(0); d < hintlessDigits; d++ {
+			a, b := rlweRing.NewPoly(), rlweRing.NewPoly()
+			for k := uint64(0); k < l.groups; k++ {
+				plain := polyFromRows(server.Data[g], (k*hintlessDigits+d)*num_moduli)
+				rlweRing.MulCoeffsAdd(as[k], plain, a)
+				rlweRing.MulCoeffsAdd(bs[k], plain, b)
+			}
+			rlweRing.INTT(b)
+
+			row := (g*hintlessDigits + d) * num_moduli
+			polyToRows(a, randoms, row)
+			for i := uint64(0); i < num_moduli; i++ {
+				out.setRow(row+i, b.Coeffs[i][:l.rows])
+			}
+		}
+	}
+	return randoms, out, nil
+}
+
+// Checks that answer has the shape of an answer to a batch of num_queries
+// queries. Clients should call this before Recover.
+func (pi *HintlessPIR) CheckAnswer(answer Msg, num_queries uint64, p Params, info DBinfo) error {
+	if uint64(len(answer.Data)) != 1+2*num_queries {
+		return fmt.Errorf("%w: got %d matrices, want %d", ErrMalformedAnswer, len(answer.Data), 1+2*num_queries)
+	}
+	if err := pi.SimplePIR.CheckAnswer(MakeMsg(answer.Data[0]), num_queries, p, info); err != nil {
+		return err
+	}
+	l := hintlessLayoutFor(p)
+	for b := uint64(0); b < num_queries; b++ {
+		if err := checkResidues(answer.Data[1+2*b], l.windows*hintlessDigits, rlweN); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedAnswer, err)
+		}
+		if err := checkResidues(answer.Data[2+2*b], l.windows*hintlessDigits, l.rows); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedAnswer, err)
+		}
+	}
+	return nil
+}
+
+func (pi *HintlessPIR) Recover(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) uint64 {
+	val, _ := pi.RecoverNoise(i, batch_index, offline, query, answer, shared, client, p, info)
+	return val
+}
+
+// Like Recover, but also reports the noise in each decoded Z_p elem. Does not
+// use the offline download, which is empty.
+func (pi *HintlessPIR) RecoverNoise(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) (uint64, *NoiseReport) {
+	defer observeSince(MetricRecoverSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricRecoveries, 1, "scheme", pi.Name())
+
+	l := hintlessLayoutFor(p)
+	num_moduli := uint64(rlweNumModuli)
+	z := polyFromRows(client.Data[1], 0)
+	randoms := answer.Data[1+2*batch_index]
+	bodies := answer.Data[2+2*batch_index]
+
+	// decrypt the entries of H * s in the rows of the queried entry
+	interm := MatrixZeros(p.L, 1)
+	row := info.elemIndex(i) / p.M
+	decrypted := make(map[uint64]*ring.Poly)
+	for j := row * info.Ne; j < (row+1)*info.Ne; j++ {
+		g := j / l.rows
+		val := uint64(0)
+		for d := uint64(0); d < hintlessDigits; d++ {
+			idx := (g*hintlessDigits + d) * num_moduli
+			a, ok := decrypted[idx]
+			if !ok {
+				a = polyFromRows(randoms, idx)
+				rlweRing.MulCoeffs(a, z, a)
+				rlweRing.INTT(a)
+				decrypted[idx] = a
+			}
+
+			r0 := (a.Coeffs[0][j%l.rows] + bodies.Get(idx, j%l.rows)) % rlweModuli[0]
+			r1 := (a.Coeffs[1][j%l.rows] + bodies.Get(idx+1, j%l.rows)) % rlweModuli[1]
+			val += rlweDecode(r0, r1) << (d * hintlessDigitBits)
+		}
+		interm.Set(val%(1<<32), j, 0)
+	}
+
+	return simpleDecode(pi.Name(), i, query, answer, interm, p, info)
+}
+
+func (pi *HintlessPIR) RecoverStreamed(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	client State, p Params, info DBinfo) uint64 {
+	return pi.Recover(i, batch_index, offline, query, answer, State{}, client, p, info)
+}
@@ -2,20 +2,113 @@ package pir
 
 import "time"
 import "fmt"
+import "io"
 import "os"
 import "bufio"
 import "math"
+import "strings"
+import "sync"
 
-func printTime(start time.Time) time.Duration {
+// Logging interface used throughout this package. Its method set matches that
+// of *slog.Logger, so a slog logger can be passed to SetLogger directly. Args
+// are alternating keys and values.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Severity of a log message; the values match those of slog.Level.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// The library is silent unless the caller installs a logger.
+var logger Logger = nopLogger{}
+
+// Sets the logger used by this package. Passing nil silences all logging.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
+
+// Logger that writes one line per message of at least the given level to w,
+// as "LEVEL msg key=value ...".
+func NewWriterLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level}
+}
+
+type writerLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+func (l *writerLogger) Debug(msg string, args ...any) { l.log(LevelDebug, msg, args) }
+func (l *writerLogger) Info(msg string, args ...any)  { l.log(LevelInfo, msg, args) }
+func (l *writerLogger) Warn(msg string, args ...any)  { l.log(LevelWarn, msg, args) }
+func (l *writerLogger) Error(msg string, args ...any) { l.log(LevelError, msg, args) }
+
+func (l *writerLogger) log(level Level, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", level, msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+		}
+	}
+	b.WriteString("\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+func logTime(msg string, start time.Time) time.Duration {
 	elapsed := time.Since(start)
-	fmt.Printf("\tElapsed: %s\n", elapsed)
+	logger.Info(msg, "elapsed", elapsed)
 	return elapsed
 }
 
-func printRate(p Params, elapsed time.Duration, batch_sz int) float64 {
+func logRate(p Params, elapsed time.Duration, batch_sz int) float64 {
 	rate := math.Log2(float64((p.P))) * float64(p.L*p.M) * float64(batch_sz) /
 		float64(8*1024*1024*elapsed.Seconds())
-	fmt.Printf("\tRate: %f MB/s\n", rate)
+	logger.Info("answer rate", "rate_mb_s", rate, "batch_size", batch_sz)
 	return rate
 }
 
@@ -0,0 +1,177 @@
+package pir
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Reusing an LWE secret across two queries leaks the difference between the
+// queried indexes, and a client State holds the secrets of one query. A
+// QueryManager issues the queries of one client, and makes sure that each
+// secret is used for a single query: it never issues a secret twice (e.g.,
+// from a query pool that was restored from disk twice), even as part of
+// another client State (e.g., DoublePIR's secret1 with fresh secrets2), and
+// recovers at most once with each client State it issued.
+//
+// The manager keeps track of secrets in memory only, so it cannot catch reuse
+// across restarts of the client.
+
+var ErrStateUsed = errors.New("pir: client state was already used to recover")
+var ErrUnknownState = errors.New("pir: client state was not issued by this manager")
+
+type secretDigest [sha256.Size]byte
+
+func digestMatrix(m *Matrix) secretDigest {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, []uint64{m.Rows, m.Cols})
+	binary.Write(h, binary.LittleEndian, m.Data)
+	var d secretDigest
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+func digestState(client State) secretDigest {
+	h := sha256.New()
+	for _, m := range client.Data {
+		d := digestMatrix(m)
+		h.Write(d[:])
+	}
+	var d secretDigest
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+type QueryManager struct {
+	pi          PIR
+	shared      State
+	p           Params
+	info        DBinfo
+	pool        *QueryPool
+	pool_shared SharedDigest // of shared, once a pool is in use
+
+	mu      sync.Mutex
+	secrets map[secretDigest]bool // every secret matrix issued
+	issued  map[secretDigest]bool // per client State: true until it is used to recover
+}
+
+func NewQueryManager(pi PIR, shared State, p Params, info DBinfo) *QueryManager {
+	return &QueryManager{
+		pi:      pi,
+		shared:  shared,
+		p:       p,
+		info:    info,
+		secrets: make(map[secretDigest]bool),
+		issued:  make(map[secretDigest]bool),
+	}
+}
+
+// Takes queries from pool (which must be a SimplePIR pool) while it lasts.
+// Once the pool is empty, queries are built online instead. Returns
+// ErrMalformedPool if pool was not built for the manager's shared state and
+// parameters.
+func (m *QueryManager) UsePool(pool *QueryPool) error {
+	if _, ok := m.pi.(*SimplePIR); !ok {
+		panic("Query pools are only supported for SimplePIR")
+	}
+	if m.pool == nil {
+		m.pool_shared = DigestSharedState(m.shared)
+	}
+	if err := pool.check(m.pool_shared, m.p, m.info); err != nil {
+		return err
+	}
+	m.pool = pool
+	return nil
+}
+
+// Records client as issued, unless any of its secrets was issued before (or
+// it holds the same secret twice).
+func (m *QueryManager) issue(client State) bool {
+	secrets := make(map[secretDigest]bool)
+	for _, s := range client.Data {
+		secrets[digestMatrix(s)] = true
+	}
+	if len(secrets) != len(client.Data) {
+		return false
+	}
+	d := digestState(client)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.issued[d]; ok {
+		return false
+	}
+	for sd := range secrets {
+		if m.secrets[sd] {
+			return false
+		}
+	}
+	for sd := range secrets {
+		m.secrets[sd] = true
+	}
+	m.issued[d] = true
+	return true
+}
+
+// Builds a query for index i, with secrets that were never issued before.
+func (m *QueryManager) Query(i uint64) (State, Msg) {
+	if m.pool != nil {
+		pi := m.pi.(*SimplePIR)
+		for {
+			client, query, err := pi.QueryFromPool(i, m.pool, m.pool_shared, m.p, m.info)
+			if err != nil {
+				metrics.AddCounter(MetricPoolMisses, 1, "scheme", m.pi.Name())
+				logger.Debug("query pool exhausted; building query online", "scheme", m.pi.Name())
+				break
+			}
+			if m.issue(client) {
+				return client, query
+			}
+			logger.Warn("discarding pooled query with reused secret", "scheme", m.pi.Name())
+		}
+	}
+
+	for {
+		client, query := m.pi.Query(i, m.shared, m.p, m.info)
+		if m.issue(client) {
+			return client, query
+		}
+	}
+}
+
+// Like RecoverChecked, but also returns ErrUnknownState if client was not
+// issued by this manager, and ErrStateUsed if client was already used to
+// recover.
+func (m *QueryManager) Recover(i uint64, batch_index uint64, num_queries uint64, offline Msg, query Msg,
+	answer Msg, client State) (uint64, error) {
+	d := digestState(client)
+
+	m.mu.Lock()
+	outstanding, ok := m.issued[d]
+	if ok && outstanding {
+		m.issued[d] = false
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return 0, ErrUnknownState
+	}
+	if !outstanding {
+		return 0, ErrStateUsed
+	}
+	return RecoverChecked(m.pi, i, batch_index, num_queries, offline, query, answer, m.shared, client, m.p, m.info)
+}
+
+// Returns the number of issued queries that were not yet recovered.
+func (m *QueryManager) Outstanding() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, outstanding := range m.issued {
+		if outstanding {
+			n += 1
+		}
+	}
+	return n
+}
@@ -3,8 +3,13 @@ package pir
 // #cgo CFLAGS: -O3 -march=native
 // #include "pir.h"
 import "C"
+import "context"
+import "encoding/binary"
 import "fmt"
-import "math/big"
+import "math/bits"
+
+// Number of rows that the *Ctx variants process between cancellation checks.
+const ctxRowBlock = uint64(1024)
 
 type Matrix struct {
 	Rows uint64
@@ -35,14 +40,46 @@ func MatrixNewNoAlloc(rows uint64, cols uint64) *Matrix {
 	return out
 }
 
+// Samples a matrix with entries uniform mod 2^logmod (if mod is 0) or mod.
+// Entries are read from the PRG in bulk, as little-endian 32-bit words masked
+// to the bit length of the modulus; entries mod a non-power of two are
+// rejection sampled. The entries are thus a fixed function of the PRG stream,
+// so that seeded expansion agrees between client and server.
 func MatrixRand(rows uint64, cols uint64, logmod uint64, mod uint64) *Matrix {
+	return matrixRandFrom(RandBytes, rows, cols, logmod, mod)
+}
+
+// Like MatrixRand, but reads the random bytes with read.
+func matrixRandFrom(read func([]byte), rows uint64, cols uint64, logmod uint64, mod uint64) *Matrix {
 	out := MatrixNew(rows, cols)
-	m := big.NewInt(int64(mod))
+
 	if mod == 0 {
-		m = big.NewInt(1 << logmod)
+		if logmod > 32 {
+			panic("Modulus does not fit in an Elem")
+		}
+		mod = 1 << logmod
 	}
-	for i := 0; i < len(out.Data); i++ {
-		out.Data[i] = C.Elem(RandInt(m).Uint64())
+	if mod > (1 << 32) {
+		panic("Modulus does not fit in an Elem")
+	}
+	mask := uint32((uint64(1) << bits.Len64(mod-1)) - 1)
+
+	var buf [bufSize]byte
+	i := 0
+	for i < len(out.Data) {
+		// read only as many words as are still needed, if all are accepted
+		n := 4 * (len(out.Data) - i)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		read(buf[:n])
+		for j := 0; j < n; j += 4 {
+			v := binary.LittleEndian.Uint32(buf[j:]) & mask
+			if uint64(v) < mod {
+				out.Data[i] = C.Elem(v)
+				i += 1
+			}
+		}
 	}
 	return out
 }
@@ -57,8 +94,10 @@ func MatrixZeros(rows uint64, cols uint64) *Matrix {
 
 func MatrixGaussian(rows, cols uint64) *Matrix {
 	out := MatrixNew(rows, cols)
-	for i := 0; i < len(out.Data); i++ {
-		out.Data[i] = C.Elem(GaussSample())
+	samples := make([]int64, len(out.Data))
+	GaussSampleVec(samples)
+	for i, s := range samples {
+		out.Data[i] = C.Elem(s)
 	}
 	return out
 }
@@ -90,9 +129,25 @@ func (m *Matrix) Set(val, i, j uint64) {
 	m.Data[i*m.Cols+j] = C.Elem(val)
 }
 
+// Copies row i of m into out, which must hold m.Cols values.
+func (m *Matrix) getRow(i uint64, out []uint64) {
+	row := m.Data[i*m.Cols : (i+1)*m.Cols]
+	for j, v := range row {
+		out[j] = uint64(v)
+	}
+}
+
+// Sets row i of m to vals (truncated to 32 bits), which must hold m.Cols values.
+func (m *Matrix) setRow(i uint64, vals []uint64) {
+	row := m.Data[i*m.Cols : (i+1)*m.Cols]
+	for j := range row {
+		row[j] = C.Elem(vals[j])
+	}
+}
+
 func (a *Matrix) MatrixAdd(b *Matrix) {
 	if (a.Cols != b.Cols) || (a.Rows != b.Rows) {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
+		logger.Error("dimension mismatch", "a_rows", a.Rows, "a_cols", a.Cols, "b_rows", b.Rows, "b_cols", b.Cols)
 		panic("Dimension mismatch")
 	}
 	for i := uint64(0); i < a.Cols*a.Rows; i++ {
@@ -116,7 +171,7 @@ func (a *Matrix) AddAt(val, i, j uint64) {
 
 func (a *Matrix) MatrixSub(b *Matrix) {
 	if (a.Cols != b.Cols) || (a.Rows != b.Rows) {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
+		logger.Error("dimension mismatch", "a_rows", a.Rows, "a_cols", a.Cols, "b_rows", b.Rows, "b_cols", b.Cols)
 		panic("Dimension mismatch")
 	}
 	for i := uint64(0); i < a.Cols*a.Rows; i++ {
@@ -136,7 +191,7 @@ func MatrixMul(a *Matrix, b *Matrix) *Matrix {
 		return MatrixMulVec(a, b)
 	}
 	if a.Cols != b.Rows {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
+		logger.Error("dimension mismatch", "a_rows", a.Rows, "a_cols", a.Cols, "b_rows", b.Rows, "b_cols", b.Cols)
 		panic("Dimension mismatch")
 	}
 
@@ -154,8 +209,21 @@ func MatrixMul(a *Matrix, b *Matrix) *Matrix {
 	return out
 }
 
+// Like MatrixMul, but checks ctx for cancellation between blocks of rows of a.
+func MatrixMulCtx(ctx context.Context, a *Matrix, b *Matrix) (*Matrix, error) {
+	out := MatrixNew(a.Rows, b.Cols)
+	for off := uint64(0); off < a.Rows; off += ctxRowBlock {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		blk := MatrixMul(a.SelectRows(off, ctxRowBlock), b)
+		copy(out.Data[off*b.Cols:], blk.Data)
+	}
+	return out, nil
+}
+
 func MatrixMulTransposedPacked(a *Matrix, b *Matrix, basis, compression uint64) *Matrix {
-        fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Cols, b.Rows)
+        logger.Debug("multiplying transposed packed", "a_rows", a.Rows, "a_cols", a.Cols, "b_cols", b.Cols, "b_rows", b.Rows)
         if compression != 3 && basis != 10 {
                 panic("Must use hard-coded values!")
         }
@@ -177,7 +245,7 @@ func MatrixMulTransposedPacked(a *Matrix, b *Matrix, basis, compression uint64)
 
 func MatrixMulVec(a *Matrix, b *Matrix) *Matrix {
 	if (a.Cols != b.Rows) && (a.Cols+1 != b.Rows) && (a.Cols+2 != b.Rows) { // do not require exact match because of DB compression
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
+		logger.Error("dimension mismatch", "a_rows", a.Rows, "a_cols", a.Cols, "b_rows", b.Rows, "b_cols", b.Cols)
 		panic("Dimension mismatch")
 	}
 	if b.Cols != 1 {
@@ -199,7 +267,7 @@ func MatrixMulVec(a *Matrix, b *Matrix) *Matrix {
 
 func MatrixMulVecPacked(a *Matrix, b *Matrix, basis, compression uint64) *Matrix {
 	if a.Cols*compression != b.Rows {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
+		logger.Error("dimension mismatch", "a_rows", a.Rows, "a_cols", a.Cols, "b_rows", b.Rows, "b_cols", b.Cols)
 		panic("Dimension mismatch")
 	}
 	if b.Cols != 1 {
@@ -221,6 +289,20 @@ func MatrixMulVecPacked(a *Matrix, b *Matrix, basis, compression uint64) *Matrix
 	return out
 }
 
+// Like MatrixMulVecPacked, but checks ctx for cancellation between blocks of
+// rows of a.
+func MatrixMulVecPackedCtx(ctx context.Context, a *Matrix, b *Matrix, basis, compression uint64) (*Matrix, error) {
+	out := MatrixNew(a.Rows, 1)
+	for off := uint64(0); off < a.Rows; off += ctxRowBlock {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		blk := MatrixMulVecPacked(a.SelectRows(off, ctxRowBlock), b, basis, compression)
+		copy(out.Data[off:], blk.Data)
+	}
+	return out, nil
+}
+
 func (m *Matrix) Transpose() {
 	if m.Cols == 1 {
 		m.Cols = m.Rows
@@ -256,7 +338,7 @@ func (a *Matrix) Concat(b *Matrix) {
 	}
 
 	if a.Cols != b.Cols {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
+		logger.Error("dimension mismatch", "a_rows", a.Rows, "a_cols", a.Cols, "b_rows", b.Rows, "b_cols", b.Cols)
 		panic("Dimension mismatch")
 	}
 
@@ -397,6 +479,17 @@ func (m *Matrix) SelectColumn(i uint64) *Matrix {
 	return col
 }
 
+// Returns the 1 x Cols matrix of the sums of m's columns (mod 2^32).
+func (m *Matrix) ColumnSums() *Matrix {
+	sums := MatrixZeros(1, m.Cols)
+	for i := uint64(0); i < m.Rows; i++ {
+		for j := uint64(0); j < m.Cols; j++ {
+			sums.Data[j] += m.Data[i*m.Cols+j]
+		}
+	}
+	return sums
+}
+
 func (m *Matrix) SelectRows(offset, num_rows uint64) *Matrix {
 	if (offset == 0) && (num_rows == m.Rows) {
 		return m
@@ -434,6 +527,18 @@ func (m *Matrix) RowsDeepCopy(offset, num_rows uint64) *Matrix {
 	return m2
 }
 
+func (m *Matrix) ColsDeepCopy(offset, num_cols uint64) *Matrix {
+	if offset+num_cols > m.Cols {
+		panic("Requesting too many cols")
+	}
+
+	m2 := MatrixNew(m.Rows, num_cols)
+	for i := uint64(0); i < m.Rows; i++ {
+		copy(m2.Data[i*num_cols:(i+1)*num_cols], m.Data[i*m.Cols+offset:i*m.Cols+offset+num_cols])
+	}
+	return m2
+}
+
 func (m *Matrix) ConcatCols(n uint64) {
 	if n == 1 {
 		return
@@ -0,0 +1,240 @@
+package pir
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink for the counters and histograms that the PIR schemes record. Labels are
+// alternating keys and values; every metric recorded by this package carries a
+// "scheme" label.
+type Metrics interface {
+	AddCounter(name string, delta float64, labels ...string)
+	Observe(name string, value float64, labels ...string)
+}
+
+// Names of the metrics recorded by Setup, Query, Answer and Recover.
+const (
+	MetricSetups          = "pir_setups_total"
+	MetricSetupSeconds    = "pir_setup_duration_seconds"
+	MetricHintDownloads   = "pir_hint_downloads_total"
+	MetricQueriesBuilt    = "pir_queries_built_total"
+	MetricQuerySeconds    = "pir_query_duration_seconds"
+	MetricQueriesAnswered = "pir_queries_answered_total"
+	MetricBytesScanned    = "pir_bytes_scanned_total"
+	MetricAnswerSeconds   = "pir_answer_duration_seconds"
+	MetricAnswerBatchSize = "pir_answer_batch_size"
+	MetricRecoveries      = "pir_recoveries_total"
+	MetricRecoverSeconds  = "pir_recover_duration_seconds"
+	MetricPoolMisses      = "pir_query_pool_misses_total" // queries built online as the pool ran dry
+)
+
+// Like logging, metrics are dropped unless the caller installs a sink.
+var metrics Metrics = nopMetrics{}
+
+// Sets the metrics sink used by this package. Passing nil drops all metrics.
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	metrics = m
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) AddCounter(name string, delta float64, labels ...string) {}
+func (nopMetrics) Observe(name string, value float64, labels ...string)    {}
+
+// Records that a client downloaded the hint produced by pi's Setup. The
+// library cannot see hint downloads itself, so servers call this when they
+// send the hint out.
+func RecordHintDownload(pi PIR) {
+	metrics.AddCounter(MetricHintDownloads, 1, "scheme", pi.Name())
+}
+
+func observeSince(name, scheme string, start time.Time) {
+	metrics.Observe(name, time.Since(start).Seconds(), "scheme", scheme)
+}
+
+// Size in bytes of a matrix in memory (Elems are 32 bits).
+func matrixBytes(m *Matrix) uint64 {
+	return m.Rows * m.Cols * 4
+}
+
+// Upper bounds of the histogram buckets: durations (metrics named *_seconds)
+// use latency buckets, everything else (e.g. batch sizes) powers of two.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60, 300}
+var sizeBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+func bucketsFor(name string) []float64 {
+	if strings.HasSuffix(name, "_seconds") {
+		return latencyBuckets
+	}
+	return sizeBuckets
+}
+
+// In-process Metrics implementation that keeps every series in memory and
+// exports them in the Prometheus text exposition format. A Registry is an
+// http.Handler, so it can be mounted directly at /metrics.
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[series]float64
+	histograms map[series]*histogram
+}
+
+type series struct {
+	name   string
+	labels string // rendered as k1="v1",k2="v2"
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[series]float64),
+		histograms: make(map[series]*histogram),
+	}
+}
+
+func renderLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic("Labels must be key-value pairs")
+	}
+	var parts []string
+	for i := 0; i < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *Registry) AddCounter(name string, delta float64, labels ...string) {
+	s := series{name, renderLabels(labels)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[s] += delta
+}
+
+func (r *Registry) Observe(name string, value float64, labels ...string) {
+	s := series{name, renderLabels(labels)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[s]
+	if !ok {
+		b := bucketsFor(name)
+		h = &histogram{buckets: b, counts: make([]uint64, len(b))}
+		r.histograms[s] = h
+	}
+	for i, le := range h.buckets {
+		if value <= le {
+			h.counts[i] += 1
+			break
+		}
+	}
+	h.sum += value
+	h.count += 1
+}
+
+// Returns the current value of a counter (0 if it was never incremented).
+func (r *Registry) Counter(name string, labels ...string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[series{name, renderLabels(labels)}]
+}
+
+// Returns the number of observations and their sum for a histogram.
+func (r *Registry) Histogram(name string, labels ...string) (uint64, float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[series{name, renderLabels(labels)}]
+	if !ok {
+		return 0, 0
+	}
+	return h.count, h.sum
+}
+
+func sortedSeries[V any](m map[series]V) []series {
+	var out []series
+	for s := range m {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].name != out[j].name {
+			return out[i].name < out[j].name
+		}
+		return out[i].labels < out[j].labels
+	})
+	return out
+}
+
+func withLabel(labels, key, val string) string {
+	l := fmt.Sprintf("%s=%q", key, val)
+	if labels == "" {
+		return l
+	}
+	return labels + "," + l
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+// Writes all series in the Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	last := ""
+	for _, s := range sortedSeries(r.counters) {
+		if s.name != last {
+			fmt.Fprintf(&b, "# TYPE %s counter\n", s.name)
+			last = s.name
+		}
+		fmt.Fprintf(&b, "%s{%s} %s\n", s.name, s.labels, formatFloat(r.counters[s]))
+	}
+
+	last = ""
+	for _, s := range sortedSeries(r.histograms) {
+		h := r.histograms[s]
+		if s.name != last {
+			fmt.Fprintf(&b, "# TYPE %s histogram\n", s.name)
+			last = s.name
+		}
+		cumulative := uint64(0)
+		for i, le := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket{%s} %d\n", s.name,
+				withLabel(s.labels, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket{%s} %d\n", s.name,
+			withLabel(s.labels, "le", formatFloat(math.Inf(1))), h.count)
+		fmt.Fprintf(&b, "%s_sum{%s} %s\n", s.name, s.labels, formatFloat(h.sum))
+		fmt.Fprintf(&b, "%s_count{%s} %d\n", s.name, s.labels, h.count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.WritePrometheus(w); err != nil {
+		logger.Error("writing metrics", "err", err)
+	}
+}
@@ -0,0 +1,78 @@
+package pir
+
+// #cgo CFLAGS: -O3 -march=native
+// #include "pir.h"
+import "C"
+
+// Modulus switching of answers. The elems of an answer are LWE ciphertext
+// bodies mod 2^Logq, whose low bits carry only noise: the server rounds each
+// to modulus 2^Logq_answer, by dropping its low Logq - Logq_answer bits, and
+// packs them densely into Elems, which cuts the download by a factor of
+// Logq / Logq_answer. The client shifts them back up and decodes as usual; the
+// rounding just adds an error of at most 2^(Logq - Logq_answer - 1) to the
+// noise of each elem.
+//
+// Only ciphertext bodies can be switched: the client multiplies the other
+// parts of an answer (DoublePIR's h1) by its uniformly random LWE secret,
+// which would blow up their rounding errors.
+
+// Returns the number of Elems that packing rows elems of logq bits takes.
+func packedRows(rows, logq uint64) uint64 {
+	return (rows*logq + 31) / 32
+}
+
+// Returns the column vector v switched to modulus 2^p.Logq_answer and packed,
+// or v itself if p does not switch answers.
+func switchAnswer(v *Matrix, p Params) *Matrix {
+	logq := p.answerLogq()
+	if logq == p.Logq {
+		return v
+	}
+	shift := p.Logq - logq
+	mask := uint64(1)<<logq - 1
+
+	out := MatrixZeros(packedRows(uint64(len(v.Data)), logq), 1)
+	for j, x := range v.Data {
+		y := ((uint64(x) + 1<<(shift-1)) >> shift) & mask
+		pos := uint64(j) * logq
+		w, off := pos/32, pos%32
+		out.Data[w] |= C.Elem(y << off)
+		if off+logq > 32 {
+			out.Data[w+1] |= C.Elem(y >> (32 - off))
+		}
+	}
+	return out
+}
+
+// Returns the column vector of rows elems packed by switchAnswer, shifted back
+// up to modulus 2^p.Logq; or packed itself if p does not switch answers.
+func unswitchAnswer(packed *Matrix, rows uint64, p Params) *Matrix {
+	logq := p.answerLogq()
+	if logq == p.Logq {
+		return packed
+	}
+	shift := p.Logq - logq
+	mask := uint64(1)<<logq - 1
+
+	out := MatrixNew(rows, 1)
+	for j := range out.Data {
+		pos := uint64(j) * logq
+		w, off := pos/32, pos%32
+		y := uint64(packed.Data[w]) >> off
+		if off+logq > 32 {
+			y |= uint64(packed.Data[w+1]) << (32 - off)
+		}
+		out.Data[j] = C.Elem((y & mask) << shift)
+	}
+	return out
+}
+
+// Checks that m is a column vector of rows ciphertext bodies, as sent by
+// switchAnswer.
+func checkAnswerVector(m *Matrix, rows uint64, p Params) error {
+	logq := p.answerLogq()
+	if logq == p.Logq {
+		return checkMatrix(m, rows, 1, p.Logq)
+	}
+	return checkMatrix(m, packedRows(rows, logq), 1, 32)
+}
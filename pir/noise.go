@@ -0,0 +1,83 @@
+package pir
+
+import "math"
+
+// Fraction of the noise budget (Delta/2) above which a decoded Z_p elem is
+// flagged as a probable decryption failure. Noise that exceeds the budget wraps
+// around to a neighboring multiple of Delta and so cannot be observed directly;
+// with parameters from params.csv, honest noise stays far below this.
+const DefaultNoiseThreshold = 0.75
+
+// Noise in the Z_p elems decoded by one call to RecoverNoise.
+type NoiseReport struct {
+	Delta     uint64  // scaling factor; decoding is correct while |noise| < Delta/2
+	Threshold float64 // flag elems whose noise uses more than this fraction of Delta/2
+
+	Noise []int64 // signed noise in each Z_p elem of the recovered record
+	Inner []int64 // DoublePIR only: noise in the elems decoded from the answer to q1
+}
+
+func newNoiseReport(p Params) *NoiseReport {
+	return &NoiseReport{Delta: p.Delta(), Threshold: DefaultNoiseThreshold}
+}
+
+// Summary statistics of a set of noise samples.
+type NoiseStats struct {
+	Count  uint64
+	Mean   float64
+	Stddev float64
+	Max    uint64 // largest magnitude
+}
+
+func summarizeNoise(samples []int64) NoiseStats {
+	s := NoiseStats{Count: uint64(len(samples))}
+	if s.Count == 0 {
+		return s
+	}
+
+	sum, sum_sq := float64(0), float64(0)
+	for _, e := range samples {
+		sum += float64(e)
+		sum_sq += float64(e) * float64(e)
+		if abs := uint64(math.Abs(float64(e))); abs > s.Max {
+			s.Max = abs
+		}
+	}
+	s.Mean = sum / float64(s.Count)
+	s.Stddev = math.Sqrt(math.Max(sum_sq/float64(s.Count)-s.Mean*s.Mean, 0))
+	return s
+}
+
+func (r *NoiseReport) Stats() NoiseStats {
+	return summarizeNoise(r.Noise)
+}
+
+func (r *NoiseReport) InnerStats() NoiseStats {
+	return summarizeNoise(r.Inner)
+}
+
+// Returns the largest fraction of the noise budget Delta/2 used by any decoded
+// elem, in either layer.
+func (r *NoiseReport) Budget() float64 {
+	max := r.Stats().Max
+	if inner := r.InnerStats().Max; inner > max {
+		max = inner
+	}
+	return float64(max) / float64(r.Delta/2)
+}
+
+// Reports whether some decoded elem came close enough to the decision boundary
+// that the recovered record is probably wrong.
+func (r *NoiseReport) ProbableFailure() bool {
+	return r.Budget() > r.Threshold
+}
+
+// Adds the samples of other to r, e.g. to collect statistics over many queries.
+func (r *NoiseReport) Merge(other *NoiseReport) {
+	if r.Delta == 0 {
+		r.Delta = other.Delta
+		r.Threshold = other.Threshold
+	}
+	r.Noise = append(r.Noise, other.Noise...)
+	r.Inner = append(r.Inner, other.Inner...)
+}
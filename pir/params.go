@@ -3,7 +3,6 @@ package pir
 import "math"
 import "strings"
 import "strconv"
-import "fmt"
 import _ "embed"
 
 //go:embed params.csv
@@ -18,6 +17,10 @@ type Params struct {
 
 	Logq uint64 // (logarithm of) ciphertext modulus
 	P    uint64 // plaintext modulus
+
+	// (logarithm of) the modulus that answers are switched to before they are
+	// sent, to shrink them; 0 to send answers mod 2^Logq
+	Logq_answer uint64
 }
 
 func (p *Params) Delta() uint64 {
@@ -28,12 +31,29 @@ func (p *Params) delta() uint64 {
 	return uint64(math.Ceil(float64(p.Logq) / math.Log2(float64(p.P))))
 }
 
+// Returns the (logarithm of the) modulus that answers are sent under.
+func (p *Params) answerLogq() uint64 {
+	if p.Logq_answer == 0 || p.Logq_answer >= p.Logq {
+		return p.Logq
+	}
+	return p.Logq_answer
+}
+
 func (p *Params) Round(x uint64) uint64 {
 	Delta := p.Delta()
 	v := (x + Delta/2) / Delta
 	return v % p.P
 }
 
+// Returns the signed distance of x (mod q) from the nearest multiple of Delta,
+// i.e. the noise that Round removes.
+func (p *Params) Noise(x uint64) int64 {
+	Delta := p.Delta()
+	x %= (1 << p.Logq)
+	v := (x + Delta/2) / Delta
+	return int64(x) - int64(v*Delta)
+}
+
 func (p *Params) PickParams(doublepir bool, samples ...uint64) {
 	if p.N == 0 || p.Logq == 0 {
 		panic("Need to specify n and q!")
@@ -75,12 +95,34 @@ func (p *Params) PickParams(doublepir bool, samples ...uint64) {
 		}
 	}
 
-	fmt.Printf("Searched for %d, %d-by-%d, %d,\n", p.N, p.L, p.M, p.Logq)
+	logger.Error("no params found", "n", p.N, "l", p.L, "m", p.M, "logq", p.Logq)
 	panic("No suitable params known!")
 }
 
+// Logs the params at Info level.
 func (p *Params) PrintParams() {
-	fmt.Printf("Working with: n=%d; db size=2^%d (l=%d, m=%d); logq=%d; p=%d; sigma=%f\n",
-		p.N, int(math.Log2(float64(p.L))+math.Log2(float64(p.M))), p.L, p.M, p.Logq,
-		p.P, p.Sigma)
+	logger.Info("working with params", "n", p.N,
+		"log_db_size", int(math.Log2(float64(p.L))+math.Log2(float64(p.M))),
+		"l", p.L, "m", p.M, "logq", p.Logq, "p", p.P, "sigma", p.Sigma)
+}
+
+// Returns the largest number of LWE samples for which params.csv lists
+// parameters with secret dimension n and ciphertext modulus 2^logq.
+func maxNumSamples(n, logq uint64) uint64 {
+	max := uint64(0)
+	lines := strings.Split(lwe_params, "\n")
+	for _, l := range lines[1:] {
+		line := strings.Split(l, ",")
+		if len(line) < 7 {
+			continue
+		}
+		logn, _ := strconv.ParseUint(line[0], 10, 64)
+		logm, _ := strconv.ParseUint(line[1], 10, 64)
+		logq_row, _ := strconv.ParseUint(line[2], 10, 64)
+
+		if (n == uint64(1<<logn)) && (logq == logq_row) && (uint64(1<<logm) > max) {
+			max = uint64(1 << logm)
+		}
+	}
+	return max
 }
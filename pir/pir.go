@@ -1,7 +1,7 @@
 package pir
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"runtime"
 	"runtime/debug"
@@ -17,30 +17,43 @@ type PIR interface {
 	PickParams(N, d, n, logq uint64) Params
 	PickParamsGivenDimensions(l, m, n, logq uint64) Params
 
-	GetBW(info DBinfo, p Params)
+	GetBW(info DBinfo, p Params) CostReport
 
 	Init(info DBinfo, p Params) State
 	InitCompressed(info DBinfo, p Params) (State, CompressedState)
 	DecompressState(info DBinfo, p Params, comp CompressedState) State
 
 	Setup(DB *Database, shared State, p Params) (State, Msg)
-	FakeSetup(DB *Database, p Params) (State, float64) // used for benchmarking online phase
+	SetupCtx(ctx context.Context, DB *Database, shared State, p Params) (State, Msg, error)
+	SetupStreamed(DB *Database, comp CompressedState, p Params) (State, Msg)
+	FakeSetup(DB *Database, p Params) State // used for benchmarking online phase
 
 	Query(i uint64, shared State, p Params, info DBinfo) (State, Msg)
+	QueryStreamed(i uint64, comp CompressedState, p Params, info DBinfo) (State, Msg)
+	CheckQuery(query Msg, p Params, info DBinfo) error
 
 	Answer(DB *Database, query MsgSlice, server State, shared State, p Params) Msg
+	AnswerCtx(ctx context.Context, DB *Database, query MsgSlice, server State, shared State, p Params) (Msg, error)
+	CheckAnswer(answer Msg, num_queries uint64, p Params, info DBinfo) error
 
 	Recover(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg, shared State, client State,
 		p Params, info DBinfo) uint64
 
+	RecoverNoise(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg, shared State, client State,
+		p Params, info DBinfo) (uint64, *NoiseReport)
+
+	RecoverStreamed(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg, client State,
+		p Params, info DBinfo) uint64
+
 	Reset(DB *Database, p Params) // reset DB to its correct state, if modified during execution
 }
 
 // Run PIR's online phase, with a random preprocessing (to skip the offline phase).
-// Gives accurate bandwidth and online time measurements.
+// Gives accurate bandwidth and online time measurements; the offline download is
+// the hint size that GetBW reports.
 func RunFakePIR(pi PIR, DB *Database, p Params, i []uint64, 
-                f *os.File, profile bool) (float64, float64, float64, float64) {
-	fmt.Printf("Executing %s\n", pi.Name())
+                f *os.File, profile bool) RunReport {
+	logger.Info("executing", "scheme", pi.Name())
 	//fmt.Printf("Memory limit: %d\n", debug.SetMemoryLimit(math.MaxInt64))
 	debug.SetGCPercent(-1)
 
@@ -50,54 +63,58 @@ func RunFakePIR(pi PIR, DB *Database, p Params, i []uint64,
 	}
 	shared_state := pi.Init(DB.Info, p)
 
-	fmt.Println("Setup...")
-	server_state, bw := pi.FakeSetup(DB, p)
-	offline_comm := bw
+	logger.Info("setup")
+	server_state := pi.FakeSetup(DB, p)
+	r := RunReport{Scheme: pi.Name(), Offline_download: pi.GetBW(DB.Info, p).Offline_download}
+	logger.Info("offline download", "kb", r.Offline_download)
 	runtime.GC()
 
-	fmt.Println("Building query...")
+	logger.Info("building query")
 	start := time.Now()
 	var query MsgSlice
 	for index, _ := range i {
 		_, q := pi.Query(i[index], shared_state, p, DB.Info)
 		query.Data = append(query.Data, q)
 	}
-	printTime(start)
-	online_comm := float64(query.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-	fmt.Printf("\t\tOnline upload: %f KB\n", online_comm)
-	bw += online_comm
+	logTime("query built", start)
+	r.Online_upload = float64(query.Size() * uint64(p.Logq) / (8.0 * 1024.0))
+	logger.Info("online upload", "kb", r.Online_upload)
 	runtime.GC()
 
-	fmt.Println("Answering query...")
+	logger.Info("answering query")
 	if profile {
 		pprof.StartCPUProfile(f)
 	}
 	start = time.Now()
 	answer := pi.Answer(DB, query, server_state, shared_state, p)
-	elapsed := printTime(start)
+	elapsed := logTime("answer computed", start)
 	if profile {
 		pprof.StopCPUProfile()
 	}
-	rate := printRate(p, elapsed, len(i))
-	online_down := float64(answer.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-	fmt.Printf("\t\tOnline download: %f KB\n", online_down)
-	bw += online_down
-	online_comm += online_down
+	r.Throughput = logRate(p, elapsed, len(i))
+	r.Online_download = float64(answer.Size() * uint64(p.Logq) / (8.0 * 1024.0))
+	logger.Info("online download", "kb", r.Online_download)
 
 	runtime.GC()
 	debug.SetGCPercent(100)
 	pi.Reset(DB, p)
 
-	if offline_comm + online_comm != bw {
-		panic("Should not happen!")
-	}
+	return r
+}
 
-	return rate, bw, offline_comm, online_comm
+// Returns the number of DB entries in the slice of the DB (which must not be
+// set up yet) that each query in a batch of num_queries scans.
+func batchEntries(DB *Database, num_queries uint64) uint64 {
+	batch_sz := DB.Data.Rows / (DB.Info.Ne * num_queries) * DB.Data.Cols
+	if DB.Info.Packing > 0 {
+		batch_sz *= DB.Info.Packing
+	}
+	return batch_sz
 }
 
 // Run full PIR scheme (offline + online phases).
 func RunPIR(pi PIR, DB *Database, p Params, i []uint64) (float64, float64) {
-	fmt.Printf("Executing %s\n", pi.Name())
+	logger.Info("executing", "scheme", pi.Name())
 	//fmt.Printf("Memory limit: %d\n", debug.SetMemoryLimit(math.MaxInt64))
 	debug.SetGCPercent(-1)
 
@@ -105,21 +122,22 @@ func RunPIR(pi PIR, DB *Database, p Params, i []uint64) (float64, float64) {
 	if DB.Data.Rows/num_queries < DB.Info.Ne {
 		panic("Too many queries to handle!")
 	}
-	batch_sz := DB.Data.Rows / (DB.Info.Ne * num_queries) * DB.Data.Cols
+	batch_sz := batchEntries(DB, num_queries)
 	bw := float64(0)
 
 	shared_state := pi.Init(DB.Info, p)
 
-	fmt.Println("Setup...")
+	logger.Info("setup")
 	start := time.Now()
 	server_state, offline_download := pi.Setup(DB, shared_state, p)
-	printTime(start)
+	logTime("setup done", start)
+	RecordHintDownload(pi)
 	comm := float64(offline_download.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-	fmt.Printf("\t\tOffline download: %f KB\n", comm)
+	logger.Info("offline download", "kb", comm)
 	bw += comm
 	runtime.GC()
 
-	fmt.Println("Building query...")
+	logger.Info("building query")
 	start = time.Now()
 	var client_state []State
 	var query MsgSlice
@@ -130,40 +148,43 @@ func RunPIR(pi PIR, DB *Database, p Params, i []uint64) (float64, float64) {
 		query.Data = append(query.Data, q)
 	}
 	runtime.GC()
-	printTime(start)
+	logTime("query built", start)
 	comm = float64(query.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-	fmt.Printf("\t\tOnline upload: %f KB\n", comm)
+	logger.Info("online upload", "kb", comm)
 	bw += comm
 	runtime.GC()
 
-	fmt.Println("Answering query...")
+	logger.Info("answering query")
 	start = time.Now()
 	answer := pi.Answer(DB, query, server_state, shared_state, p)
-	elapsed := printTime(start)
-	rate := printRate(p, elapsed, len(i))
+	elapsed := logTime("answer computed", start)
+	rate := logRate(p, elapsed, len(i))
 	comm = float64(answer.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-	fmt.Printf("\t\tOnline download: %f KB\n", comm)
+	logger.Info("online download", "kb", comm)
 	bw += comm
 	runtime.GC()
 
 	pi.Reset(DB, p)
-	fmt.Println("Reconstructing...")
+	logger.Info("reconstructing")
 	start = time.Now()
 
 	for index, _ := range i {
 		index_to_query := i[index] + uint64(index)*batch_sz
-		val := pi.Recover(index_to_query, uint64(index), offline_download, 
-		                  query.Data[index], answer, shared_state,
-			          client_state[index], p, DB.Info)
+		val, err := RecoverChecked(pi, index_to_query, uint64(index), num_queries,
+		                           offline_download, query.Data[index], answer, shared_state,
+			                   client_state[index], p, DB.Info)
+		if err != nil {
+			panic(err)
+		}
 
 		if DB.GetElem(index_to_query) != val {
-			fmt.Printf("Batch %d (querying index %d -- row should be >= %d): Got %d instead of %d\n",
-				index, index_to_query, DB.Data.Rows/4, val, DB.GetElem(index_to_query))
+			logger.Error("reconstruct failed", "batch", index, "index", index_to_query,
+				"got", val, "want", DB.GetElem(index_to_query))
 			panic("Reconstruct failed!")
 		}
 	}
-	fmt.Println("Success!")
-	printTime(start)
+	logger.Info("recovered all queries")
+	logTime("reconstruction done", start)
 
 	runtime.GC()
 	debug.SetGCPercent(100)
@@ -172,7 +193,7 @@ func RunPIR(pi PIR, DB *Database, p Params, i []uint64) (float64, float64) {
 
 // Run full PIR scheme (offline + online phases), where the transmission of the A matrix is compressed.
 func RunPIRCompressed(pi PIR, DB *Database, p Params, i []uint64) (float64, float64) {
-        fmt.Printf("Executing %s\n", pi.Name())
+        logger.Info("executing", "scheme", pi.Name())
         //fmt.Printf("Memory limit: %d\n", debug.SetMemoryLimit(math.MaxInt64))
         debug.SetGCPercent(-1)
 
@@ -180,22 +201,23 @@ func RunPIRCompressed(pi PIR, DB *Database, p Params, i []uint64) (float64, floa
         if DB.Data.Rows/num_queries < DB.Info.Ne {
                 panic("Too many queries to handle!")
         }
-        batch_sz := DB.Data.Rows / (DB.Info.Ne * num_queries) * DB.Data.Cols
+        batch_sz := batchEntries(DB, num_queries)
         bw := float64(0)
 
         server_shared_state, comp_state := pi.InitCompressed(DB.Info, p)
         client_shared_state := pi.DecompressState(DB.Info, p, comp_state)
 
-        fmt.Println("Setup...")
+        logger.Info("setup")
         start := time.Now()
         server_state, offline_download := pi.Setup(DB, server_shared_state, p)
-        printTime(start)
+        logTime("setup done", start)
+        RecordHintDownload(pi)
         comm := float64(offline_download.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-        fmt.Printf("\t\tOffline download: %f KB\n", comm)
+        logger.Info("offline download", "kb", comm)
         bw += comm
         runtime.GC()
 
-        fmt.Println("Building query...")
+        logger.Info("building query")
         start = time.Now()
         var client_state []State
         var query MsgSlice
@@ -206,42 +228,124 @@ func RunPIRCompressed(pi PIR, DB *Database, p Params, i []uint64) (float64, floa
                 query.Data = append(query.Data, q)
         }
         runtime.GC()
-        printTime(start)
+        logTime("query built", start)
         comm = float64(query.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-        fmt.Printf("\t\tOnline upload: %f KB\n", comm)
+        logger.Info("online upload", "kb", comm)
         bw += comm
         runtime.GC()
 
-        fmt.Println("Answering query...")
+        logger.Info("answering query")
         start = time.Now()
         answer := pi.Answer(DB, query, server_state, server_shared_state, p)
-        elapsed := printTime(start)
-        rate := printRate(p, elapsed, len(i))
+        elapsed := logTime("answer computed", start)
+        rate := logRate(p, elapsed, len(i))
         comm = float64(answer.Size() * uint64(p.Logq) / (8.0 * 1024.0))
-        fmt.Printf("\t\tOnline download: %f KB\n", comm)
+        logger.Info("online download", "kb", comm)
         bw += comm
         runtime.GC()
 
         pi.Reset(DB, p)
-        fmt.Println("Reconstructing...")
+        logger.Info("reconstructing")
         start = time.Now()
 
         for index, _ := range i {
                 index_to_query := i[index] + uint64(index)*batch_sz
-                val := pi.Recover(index_to_query, uint64(index), offline_download,
-                                  query.Data[index], answer, client_shared_state,
-                                  client_state[index], p, DB.Info)
+                val, err := RecoverChecked(pi, index_to_query, uint64(index), num_queries,
+                                           offline_download, query.Data[index], answer,
+                                           client_shared_state, client_state[index], p, DB.Info)
+                if err != nil {
+                        panic(err)
+                }
 
                 if DB.GetElem(index_to_query) != val {
-                        fmt.Printf("Batch %d (querying index %d -- row should be >= %d): Got %d instead of %d\n",
-                                index, index_to_query, DB.Data.Rows/4, val, DB.GetElem(index_to_query))
+                        logger.Error("reconstruct failed", "batch", index, "index", index_to_query,
+                                "got", val, "want", DB.GetElem(index_to_query))
                         panic("Reconstruct failed!")
                 }
         }
-        fmt.Println("Success!")
-        printTime(start)
+        logger.Info("recovered all queries")
+        logTime("reconstruction done", start)
 
         runtime.GC()
         debug.SetGCPercent(100)
         return rate, bw
 }
+
+// Run full PIR scheme (offline + online phases), where neither party materializes
+// the A matrix, but instead regenerates it from the compressed state as needed.
+func RunPIRStreamed(pi PIR, DB *Database, p Params, i []uint64) (float64, float64) {
+	logger.Info("executing", "scheme", pi.Name())
+	debug.SetGCPercent(-1)
+
+	num_queries := uint64(len(i))
+	if DB.Data.Rows/num_queries < DB.Info.Ne {
+		panic("Too many queries to handle!")
+	}
+	batch_sz := batchEntries(DB, num_queries)
+	bw := float64(0)
+
+	comp_state := MakeCompressedState(RandomPRGKey())
+
+	logger.Info("setup")
+	start := time.Now()
+	server_state, offline_download := pi.SetupStreamed(DB, comp_state, p)
+	logTime("setup done", start)
+	RecordHintDownload(pi)
+	comm := float64(offline_download.Size() * uint64(p.Logq) / (8.0 * 1024.0))
+	logger.Info("offline download", "kb", comm)
+	bw += comm
+	runtime.GC()
+
+	logger.Info("building query")
+	start = time.Now()
+	var client_state []State
+	var query MsgSlice
+	for index, _ := range i {
+		index_to_query := i[index] + uint64(index)*batch_sz
+		cs, q := pi.QueryStreamed(index_to_query, comp_state, p, DB.Info)
+		client_state = append(client_state, cs)
+		query.Data = append(query.Data, q)
+	}
+	runtime.GC()
+	logTime("query built", start)
+	comm = float64(query.Size() * uint64(p.Logq) / (8.0 * 1024.0))
+	logger.Info("online upload", "kb", comm)
+	bw += comm
+	runtime.GC()
+
+	logger.Info("answering query")
+	start = time.Now()
+	answer := pi.Answer(DB, query, server_state, State{}, p)
+	elapsed := logTime("answer computed", start)
+	rate := logRate(p, elapsed, len(i))
+	comm = float64(answer.Size() * uint64(p.Logq) / (8.0 * 1024.0))
+	logger.Info("online download", "kb", comm)
+	bw += comm
+	runtime.GC()
+
+	if err := pi.CheckAnswer(answer, num_queries, p, DB.Info); err != nil {
+		panic(err)
+	}
+
+	pi.Reset(DB, p)
+	logger.Info("reconstructing")
+	start = time.Now()
+
+	for index, _ := range i {
+		index_to_query := i[index] + uint64(index)*batch_sz
+		val := pi.RecoverStreamed(index_to_query, uint64(index), offline_download,
+			query.Data[index], answer, client_state[index], p, DB.Info)
+
+		if DB.GetElem(index_to_query) != val {
+			logger.Error("reconstruct failed", "batch", index, "index", index_to_query,
+				"got", val, "want", DB.GetElem(index_to_query))
+			panic("Reconstruct failed!")
+		}
+	}
+	logger.Info("recovered all queries")
+	logTime("reconstruction done", start)
+
+	runtime.GC()
+	debug.SetGCPercent(100)
+	return rate, bw
+}
@@ -1,18 +1,29 @@
 package pir
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"reflect"
 	"strconv"
 	"testing"
 	"strings"
+	"time"
 )
 
 const LOGQ = uint64(32)
 const SEC_PARAM = uint64(1 << 10)
 
+func init() {
+	SetLogger(NewWriterLogger(os.Stdout, LevelInfo))
+}
+
 // Test that DB packing methods are correct, when each database entry is ~ 1 Z_p elem.
 func TestDBMediumEntries(t *testing.T) {
 	N := uint64(4)
@@ -95,12 +106,15 @@ func TestDBInterleaving(t *testing.T) {
 		DBs[n] = MakeDB(N, d, &p, val) 
 	}
 
-	D := pir.ConcatDBs(DBs, &p)
+	D, _, tables, err := pir.ConcatDBs(DBs, p)
+	if err != nil {
+		panic(err)
+	}
 
 	for i:=uint64(0); i<N; i++ {
 		val := make([]byte, numBytes)
 		for n:=uint64(0); n<numBytes; n++ {
-			val[n] = byte(D.GetElem(i + N*n))
+			val[n] = byte(D.GetElem(tables.Index(int(n), i)))
 		}
 		fmt.Printf("Got '%s' instead of '%s'\n", string(val), "string " + fmt.Sprint(i))
 		if strings.TrimRight(string(val), "\x00") != "string " + fmt.Sprint(i) {
@@ -109,6 +123,55 @@ func TestDBInterleaving(t *testing.T) {
 	}
 }
 
+// Test combining DBs of different sizes and entry widths into one, for both
+// schemes, and retrieving entries of each of them; and that DBs whose widths
+// differ too much are rejected.
+func TestConcatDBs(t *testing.T) {
+	sizes := []uint64{1000, 1 << 14, 300}
+	widths := []uint64{8, 6, 12}
+
+	for _, pir := range []PIR{&SimplePIR{}, &DoublePIR{}} {
+		var DBs []*Database
+		for j := range sizes {
+			p := pir.PickParams(sizes[j], widths[j], SEC_PARAM, LOGQ)
+			DBs = append(DBs, MakeRandomDB(sizes[j], widths[j], &p))
+		}
+
+		concat := pir.(interface {
+			ConcatDBs(DBs []*Database, p Params) (*Database, Params, *TableMap, error)
+		})
+		D, p, tables, err := concat.ConcatDBs(DBs, Params{N: SEC_PARAM, Logq: LOGQ})
+		if err != nil {
+			panic(err)
+		}
+		if D.Info.Num != 1000+(1<<14)+300 || D.Info.Row_length != 12 || D.Data.Rows != p.L {
+			panic("Failure")
+		}
+
+		for j, DB := range DBs {
+			for i := uint64(0); i < sizes[j]; i++ {
+				index := tables.Index(j, i)
+				if table, k := tables.Locate(index); table != j || k != i {
+					panic("Failure")
+				}
+				if D.GetElem(index) != DB.GetElem(i) {
+					panic("Failure")
+				}
+			}
+		}
+
+		RunPIR(pir, D, p, []uint64{tables.Index(2, 299)})
+
+		// 2^14 1-bit entries would be widened to 40 bits
+		q1 := pir.PickParams(1<<14, 1, SEC_PARAM, LOGQ)
+		q40 := pir.PickParams(300, 40, SEC_PARAM, LOGQ)
+		bad := []*Database{MakeRandomDB(1<<14, 1, &q1), MakeRandomDB(300, 40, &q40)}
+		if _, _, _, err := concat.ConcatDBs(bad, Params{N: SEC_PARAM, Logq: LOGQ}); !errors.Is(err, ErrTableWidths) {
+			panic("Failure")
+		}
+	}
+}
+
 // Print the BW used by SimplePIR
 func TestSimplePirBW(t *testing.T) {
 	N := uint64(1 << 20)
@@ -130,7 +193,8 @@ func TestSimplePirBW(t *testing.T) {
 	fmt.Printf("Executing with entries consisting of %d (>= 1) bits; p is %d; packing factor is %d; number of DB elems per entry is %d.\n",
 		d, p.P, DB.Info.Packing, DB.Info.Ne)
 
-	pir.GetBW(DB.Info, p)
+	cost := pir.GetBW(DB.Info, p)
+	cost.Print()
 }
 
 // Print the BW used by DoublePIR
@@ -154,7 +218,8 @@ func TestDoublePirBW(t *testing.T) {
 	fmt.Printf("Executing with entries consisting of %d (>= 1) bits; p is %d; packing factor is %d; number of DB elems per entry is %d.\n",
 		d, p.P, DB.Info.Packing, DB.Info.Ne)
 
-	pir.GetBW(DB.Info, p)
+	cost := pir.GetBW(DB.Info, p)
+	cost.Print()
 }
 
 // Test SimplePIR correctness on DB with short entries.
@@ -298,6 +363,79 @@ func TestDoublePirLongRow(t *testing.T) {
 	RunPIR(&pir, DB, p, []uint64{1 << 19})
 }
 
+// Test DoublePIR correctness when each entry spans several columns of the
+// second-level DB (Ne/X > 1), so the client makes several q2 queries.
+func TestDoublePirSeveralSecondQueries(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(32)
+	pir := DoublePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	DB := MakeRandomDB(N, d, &p)
+	DB.Info.X = 1
+	if DB.Info.Ne/DB.Info.X <= 1 {
+		panic("Failure")
+	}
+
+	RunPIR(&pir, DB, p, []uint64{1 << 19})
+}
+
+// Test SimplePIR correctness on DB with several entries packed into each
+// Z_p elem, on an entry past the first row.
+func TestSimplePirPackedEntries(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(4)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	DB := MakeRandomDB(N, d, &p)
+	if DB.Info.Packing <= 1 {
+		panic("Failure")
+	}
+
+	RunPIR(&pir, DB, p, []uint64{N - 3})
+}
+
+// Test DoublePIR correctness on DB with several entries packed into each
+// Z_p elem, on an entry past the first row.
+func TestDoublePirPackedEntries(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(4)
+	pir := DoublePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	DB := MakeRandomDB(N, d, &p)
+	if DB.Info.Packing <= 1 {
+		panic("Failure")
+	}
+
+	RunPIR(&pir, DB, p, []uint64{N - 3})
+}
+
+// Test batched SimplePIR and DoublePIR on DB with several entries packed into
+// each Z_p elem, so that each query's slice of the DB holds Packing times as
+// many entries as elems.
+func TestPirPackedEntriesBatch(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(4)
+	simple := SimplePIR{}
+	p := simple.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+	if DB.Info.Packing <= 1 {
+		panic("Failure")
+	}
+	RunPIR(&simple, DB, p, []uint64{1, 2, 3, 4})
+
+	N = uint64(1 << 20)
+	double := DoublePIR{}
+	p = double.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB = MakeRandomDB(N, d, &p)
+	if DB.Info.Packing <= 1 {
+		panic("Failure")
+	}
+	RunPIR(&double, DB, p, []uint64{1, 2, 3, 4})
+}
+
 func TestDoublePirLongRowCompressed(t *testing.T) {
         N := uint64(1 << 20)
         d := uint64(32)
@@ -405,7 +543,7 @@ func BenchmarkSimplePirSingle(b *testing.B) {
 	DB := MakeRandomDB(N, d, &p)
 	var tputs []float64
 	for j := 0; j < 5; j++ {
-		tput, _, _, _ := RunFakePIR(&pir, DB, p, []uint64{i}, f, false)
+		tput := RunFakePIR(&pir, DB, p, []uint64{i}, f, false).Throughput
 		tputs = append(tputs, tput)
 	}
 	fmt.Printf("Avg SimplePIR tput, except for first run: %f MB/s\n", avg(tputs))
@@ -442,13 +580,65 @@ func BenchmarkDoublePirSingle(b *testing.B) {
 	DB := MakeRandomDB(N, d, &p)
 	var tputs []float64
 	for j := 0; j < 5; j++ {
-		tput, _, _, _ := RunFakePIR(&pir, DB, p, []uint64{i}, f, false)
+		tput := RunFakePIR(&pir, DB, p, []uint64{i}, f, false).Throughput
 		tputs = append(tputs, tput)
 	}
 	fmt.Printf("Avg DoublePIR tput, except for first run: %f MB/s\n", avg(tputs))
 	fmt.Printf("Std dev of DoublePIR tput, except for first run: %f MB/s\n", stddev(tputs))
 }
 
+// Benchmark FrodoPIR's client: the offline preprocessing of queries, and the
+// online work of a preprocessed query (building it, then recovering the
+// answer). The server side is SimplePIR's; see BenchmarkSimplePirSingle.
+func BenchmarkFrodoPirSingle(b *testing.B) {
+	N := uint64(1 << 20)
+	d := uint64(2048)
+	num_queries := uint64(16) // preprocessed at once
+
+	log_N, _ := strconv.Atoi(os.Getenv("LOG_N"))
+	D, _ := strconv.Atoi(os.Getenv("D"))
+	if log_N != 0 {
+		N = uint64(1 << log_N)
+	}
+	if D != 0 {
+		d = uint64(D)
+	}
+
+	pir := FrodoPIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+	shared, comp := pir.InitCompressed(DB.Info, p)
+	server, hint := pir.Setup(DB, shared, p)
+
+	var pre_times, online_times []float64
+	for j := 0; j < 5; j++ {
+		start := time.Now()
+		pre := pir.Preprocess(hint, comp, p, DB.Info, num_queries)
+		elapsed := logTime("preprocessed", start)
+		pre_times = append(pre_times, elapsed.Seconds()*1000/float64(num_queries))
+
+		for k := uint64(0); k < num_queries; k++ {
+			i := k * (N / num_queries)
+			start = time.Now()
+			client, query := pir.QueryPreprocessed(i, &pre, comp, p, DB.Info)
+			elapsed = time.Since(start)
+
+			answer := pir.Answer(DB, MakeMsgSlice(query), server, shared, p)
+
+			start = time.Now()
+			pir.Recover(i, 0, Msg{}, query, answer, shared, client, p, DB.Info)
+			elapsed += time.Since(start)
+			online_times = append(online_times, float64(elapsed.Microseconds()))
+		}
+	}
+	pir.Reset(DB, p)
+
+	fmt.Printf("Avg FrodoPIR preprocessing time: %f ms/query\n", avg(pre_times))
+	fmt.Printf("Std dev of FrodoPIR preprocessing time: %f ms/query\n", stddev(pre_times))
+	fmt.Printf("Avg FrodoPIR online client time (query and recover): %f us\n", avg(online_times))
+	fmt.Printf("Std dev of FrodoPIR online client time (query and recover): %f us\n", stddev(online_times))
+}
+
 // Benchmark SimplePIR performance, on 1GB databases with increasing row length.
 func BenchmarkSimplePirVaryingDB(b *testing.B) {
 	flog, err := os.OpenFile("simple-comm.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -483,10 +673,10 @@ func BenchmarkSimplePirVaryingDB(b *testing.B) {
 		var online_cs []float64
 
 		for j := 0; j < 5; j++ {
-			tput, _, offline_c, online_c := RunFakePIR(&pir, DB, p, []uint64{i}, nil, false)
-			tputs = append(tputs, tput)
-			offline_cs = append(offline_cs, offline_c)
-			online_cs = append(online_cs, online_c)
+			r := RunFakePIR(&pir, DB, p, []uint64{i}, nil, false)
+			tputs = append(tputs, r.Throughput)
+			offline_cs = append(offline_cs, r.Offline_download)
+			online_cs = append(online_cs, r.Online())
 		}
 		fmt.Printf("Avg SimplePIR tput (%d, %d), except for first run: %f MB/s\n", N, d, avg(tputs))
 		fmt.Printf("Std dev of SimplePIR tput (%d, %d), except for first run: %f MB/s\n", N, d, stddev(tputs))
@@ -536,10 +726,10 @@ func BenchmarkDoublePirVaryingDB(b *testing.B) {
 		var online_cs []float64
 
 		for j := 0; j < 5; j++ {
-			tput, _, offline_c, online_c := RunFakePIR(&pir, DB, p, []uint64{i}, nil, false)
-			tputs = append(tputs, tput)
-			offline_cs = append(offline_cs, offline_c)
-			online_cs = append(online_cs, online_c)
+			r := RunFakePIR(&pir, DB, p, []uint64{i}, nil, false)
+			tputs = append(tputs, r.Throughput)
+			offline_cs = append(offline_cs, r.Offline_download)
+			online_cs = append(online_cs, r.Online())
 		}
 		fmt.Printf("Avg SimplePIR tput (%d, %d), except for first run: %f MB/s\n", N, d, avg(tputs))
 		fmt.Printf("Std dev of SimplePIR tput (%d, %d), except for first run: %f MB/s\n", N, d, stddev(tputs))
@@ -605,7 +795,7 @@ func BenchmarkSimplePirBatchLarge(b *testing.B) {
 		}
 		var tputs []float64
 		for iter := 0; iter < 5; iter++ {
-			tput, _, _, _ := RunFakePIR(&pir, DB, p, query, f, false)
+			tput := RunFakePIR(&pir, DB, p, query, f, false).Throughput
 			tputs = append(tputs, tput)
 		}
 
@@ -671,7 +861,7 @@ func BenchmarkDoublePirBatchLarge(b *testing.B) {
 		}
 		var tputs []float64
 		for iter := 0; iter < 5; iter++ {
-			tput, _, _, _ := RunFakePIR(&pir, DB, p, query, f, false)
+			tput := RunFakePIR(&pir, DB, p, query, f, false).Throughput
 			tputs = append(tputs, tput)
 		}
 		expected_num_empty_buckets := math.Pow(float64(batch_sz-1)/float64(batch_sz), float64(batch_sz)) * float64(batch_sz)
@@ -686,3 +876,1374 @@ func BenchmarkDoublePirBatchLarge(b *testing.B) {
 			strconv.FormatFloat(avg(tputs), 'f', 4, 64)})
 	}
 }
+
+// Test that the DB shape picked for a given number of queries per hint is
+// no worse than the default (~square) one, and that SimplePIR is correct on it.
+func TestSimplePirPickParamsForQueries(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := SimplePIR{}
+
+	for _, num_queries := range []uint64{1, 100, 1000000} {
+		p, shape := pir.PickParamsForQueries(N, d, SEC_PARAM, LOGQ, num_queries)
+		fmt.Printf("%d queries: l=%d, m=%d; %f KB per query\n", num_queries, p.L, p.M,
+			shape.Cost.Amortized(num_queries))
+
+		p_square := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+		DB_square := SetupDB(N, d, &p_square)
+		square := pir.GetBW(DB_square.Info, p_square)
+		if shape.Cost.Amortized(num_queries) > square.Amortized(num_queries) {
+			panic("Optimizer picked worse shape than square DB")
+		}
+
+		DB := MakeRandomDB(N, d, &p)
+		RunPIR(&pir, DB, p, []uint64{262144})
+	}
+}
+
+// Test that the DB shape and X picked for a given number of queries per hint
+// is no worse than the default one, and that DoublePIR is correct on it.
+func TestDoublePirPickParamsForQueries(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(32)
+	pir := DoublePIR{}
+
+	for _, num_queries := range []uint64{1, 1000000} {
+		p, shape := pir.PickParamsForQueries(N, d, SEC_PARAM, LOGQ, num_queries)
+		fmt.Printf("%d queries: l=%d, m=%d, X=%d; %f KB per query\n", num_queries, p.L, p.M,
+			shape.X, shape.Cost.Amortized(num_queries))
+
+		p_default := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+		DB_default := SetupDB(N, d, &p_default)
+		def := pir.GetBW(DB_default.Info, p_default)
+		if shape.Cost.Amortized(num_queries) > def.Amortized(num_queries) {
+			panic("Optimizer picked worse shape than default DB")
+		}
+
+		DB := MakeRandomDB(N, d, &p)
+		DB.Info.X = shape.X
+		RunPIR(&pir, DB, p, []uint64{1 << 15})
+	}
+}
+
+// Test that the cost report round-trips through JSON.
+func TestCostReportJSON(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(2048)
+
+	pir := DoublePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := SetupDB(N, d, &p)
+	cost := pir.GetBW(DB.Info, p)
+
+	enc, err := json.Marshal(cost)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("%s\n", enc)
+
+	var dec CostReport
+	if err := json.Unmarshal(enc, &dec); err != nil {
+		panic(err)
+	}
+	if dec != cost || dec.Scheme != "DoublePIR" || dec.Server_ops == 0 {
+		panic("Failure")
+	}
+}
+
+// Test that the writer logger filters by level and formats key-value pairs.
+func TestWriterLogger(t *testing.T) {
+	var b strings.Builder
+	l := NewWriterLogger(&b, LevelInfo)
+	l.Debug("hidden", "k", 1)
+	l.Info("shown", "k", 1, "dangling")
+	l.Error("also shown")
+
+	if b.String() != "INFO shown k=1 !BADKEY=dangling\nERROR also shown\n" {
+		fmt.Printf("%q\n", b.String())
+		panic("Failure")
+	}
+}
+
+// Test that a full SimplePIR run records metrics into the registry.
+func TestSimplePirMetrics(t *testing.T) {
+	reg := NewRegistry()
+	SetMetrics(reg)
+	defer SetMetrics(nil)
+
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+	RunPIR(&pir, DB, p, []uint64{1, 2})
+
+	if reg.Counter(MetricSetups, "scheme", "SimplePIR") != 1 ||
+		reg.Counter(MetricHintDownloads, "scheme", "SimplePIR") != 1 ||
+		reg.Counter(MetricQueriesBuilt, "scheme", "SimplePIR") != 2 ||
+		reg.Counter(MetricQueriesAnswered, "scheme", "SimplePIR") != 2 ||
+		reg.Counter(MetricRecoveries, "scheme", "SimplePIR") != 2 ||
+		reg.Counter(MetricBytesScanned, "scheme", "SimplePIR") == 0 {
+		panic("Failure")
+	}
+	if count, sum := reg.Histogram(MetricAnswerBatchSize, "scheme", "SimplePIR"); count != 1 || sum != 2 {
+		panic("Failure")
+	}
+
+	var b strings.Builder
+	if err := reg.WritePrometheus(&b); err != nil {
+		panic(err)
+	}
+	fmt.Print(b.String())
+	if !strings.Contains(b.String(), "pir_queries_answered_total{scheme=\"SimplePIR\"} 2\n") ||
+		!strings.Contains(b.String(), "pir_answer_batch_size_bucket{scheme=\"SimplePIR\",le=\"2\"} 1\n") ||
+		!strings.Contains(b.String(), "pir_answer_duration_seconds_count{scheme=\"SimplePIR\"} 1\n") {
+		panic("Failure")
+	}
+
+	// an answer that is given up on is not counted as answered, nor are the
+	// bytes it would have scanned
+	scanned := reg.Counter(MetricBytesScanned, "scheme", "SimplePIR")
+	shared := pir.Init(DB.Info, p)
+	server, _ := pir.Setup(DB, shared, p)
+	_, q := pir.Query(1, shared, p, DB.Info)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pir.AnswerCtx(canceled, DB, MakeMsgSlice(q), server, shared, p); err != context.Canceled {
+		panic("Failure")
+	}
+	if reg.Counter(MetricQueriesAnswered, "scheme", "SimplePIR") != 2 ||
+		reg.Counter(MetricBytesScanned, "scheme", "SimplePIR") != scanned {
+		panic("Failure")
+	}
+}
+
+// Test that the context-aware variants match the plain ones, and give up
+// without modifying the DB once the context is canceled.
+func TestSimplePirCtx(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := MakeRandomDBCtx(canceled, N, d, &p); err != context.Canceled {
+		panic("Failure")
+	}
+	DB, err := MakeRandomDBCtx(context.Background(), N, d, &p)
+	if err != nil {
+		panic(err)
+	}
+
+	shared := pir.Init(DB.Info, p)
+	H := MatrixMul(DB.Data, shared.Data[0])
+	H_ctx, err := MatrixMulCtx(context.Background(), DB.Data, shared.Data[0])
+	if err != nil || !reflect.DeepEqual(H, H_ctx) {
+		panic("Failure")
+	}
+
+	before := DB.Data.RowsDeepCopy(0, DB.Data.Rows)
+	if _, _, err := pir.SetupCtx(canceled, DB, shared, p); err != context.Canceled {
+		panic("Failure")
+	}
+	if !reflect.DeepEqual(before, DB.Data) {
+		panic("SetupCtx modified the DB")
+	}
+
+	server, _ := pir.Setup(DB, shared, p)
+	_, q := pir.Query(1, shared, p, DB.Info)
+	query := MsgSlice{Data: []Msg{q}}
+	if _, err := pir.AnswerCtx(canceled, DB, query, server, shared, p); err != context.Canceled {
+		panic("Failure")
+	}
+	ans, err := pir.AnswerCtx(context.Background(), DB, query, server, shared, p)
+	if err != nil || !reflect.DeepEqual(ans, pir.Answer(DB, query, server, shared, p)) {
+		panic("Failure")
+	}
+	pir.Reset(DB, p)
+}
+
+// Test that a client of a verifiable DB detects a server that corrupts the
+// output of MatrixMulVecPacked in its answer.
+func TestSimplePirVerifiable(t *testing.T) {
+	N := uint64(1 << 16)
+	row_length := uint64(16)
+	tag_bits := uint64(32)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, row_length+tag_bits, SEC_PARAM, LOGQ)
+
+	key := RandomMACKey()
+	vals := make([]uint64, N)
+	for i := range vals {
+		vals[i] = uint64(i*7) % (1 << row_length)
+	}
+	DB := MakeVerifiableDB(N, row_length, tag_bits, &p, vals, key)
+
+	shared := pir.Init(DB.Info, p)
+	server, offline := pir.Setup(DB, shared, p)
+
+	index := uint64(1234)
+	client, q := pir.Query(index, shared, p, DB.Info)
+	answer := pir.Answer(DB, MakeMsgSlice(q), server, shared, p)
+
+	entry := pir.Recover(index, 0, offline, q, answer, shared, client, p, DB.Info)
+	val, err := VerifyRecord(key, index, entry, row_length, tag_bits)
+	if err != nil || val != vals[index] {
+		panic("Failure")
+	}
+	if _, err := VerifyRecord(key, index+1, entry, row_length, tag_bits); err != ErrBadMAC {
+		panic("Record verified at the wrong index")
+	}
+
+	// Shift one of the Z_p elems that make up the queried record
+	row := index / p.M
+	answer.Data[0].AddAt(p.Delta(), row*DB.Info.Ne, 0)
+	entry = pir.Recover(index, 0, offline, q, answer, shared, client, p, DB.Info)
+	if _, err := VerifyRecord(key, index, entry, row_length, tag_bits); err != ErrBadMAC {
+		panic("Corrupted answer not detected")
+	}
+	pir.Reset(DB, p)
+}
+
+// Test that the server rejects malformed queries and the client rejects
+// malformed answers, with errors rather than panics.
+func TestSimplePirMalformed(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	shared := pir.Init(DB.Info, p)
+	server, _ := pir.Setup(DB, shared, p)
+	_, q := pir.Query(1, shared, p, DB.Info)
+	if err := pir.CheckQuery(q, p, DB.Info); err != nil {
+		panic(err)
+	}
+
+	short := MakeMsg(q.Data[0].RowsDeepCopy(0, q.Data[0].Rows-1))
+	padded := MakeMsg(q.Data[0].RowsDeepCopy(0, q.Data[0].Rows))
+	padded.Data[0].AddAt(1, padded.Data[0].Rows-1, 0)
+	bad := []MsgSlice{
+		MakeMsgSlice(),
+		MakeMsgSlice(MakeMsg()),
+		MakeMsgSlice(MakeMsg(q.Data[0], q.Data[0])),
+		MakeMsgSlice(short),
+	}
+	if p.M%DB.Info.Squishing != 0 {
+		bad = append(bad, MakeMsgSlice(padded))
+	}
+	for _, query := range bad {
+		if _, err := pir.AnswerCtx(context.Background(), DB, query, server, shared, p); !errors.Is(err, ErrMalformedQuery) {
+			panic("Malformed query accepted")
+		}
+	}
+
+	answer := pir.Answer(DB, MakeMsgSlice(q), server, shared, p)
+	if err := pir.CheckAnswer(answer, 1, p, DB.Info); err != nil {
+		panic(err)
+	}
+	for _, ans := range []Msg{
+		MakeMsg(),
+		MakeMsg(answer.Data[0], answer.Data[0]),
+		MakeMsg(answer.Data[0].RowsDeepCopy(0, p.L-1)),
+	} {
+		if err := pir.CheckAnswer(ans, 1, p, DB.Info); !errors.Is(err, ErrMalformedAnswer) {
+			panic("Malformed answer accepted")
+		}
+	}
+	pir.Reset(DB, p)
+}
+
+// Test that RecoverNoise reports low noise on honest answers, and flags answers
+// pushed close to the decision boundary.
+func TestSimplePirNoise(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(32)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	if p.Noise(5*p.Delta()+3) != 3 || p.Noise(5*p.Delta()-3) != -3 {
+		panic("Failure")
+	}
+
+	shared := pir.Init(DB.Info, p)
+	server, offline := pir.Setup(DB, shared, p)
+	index := uint64(4321)
+	client, q := pir.Query(index, shared, p, DB.Info)
+	answer := pir.Answer(DB, MakeMsgSlice(q), server, shared, p)
+	pir.Reset(DB, p)
+
+	val, report := pir.RecoverNoise(index, 0, offline, q, answer, shared, client, p, DB.Info)
+	stats := report.Stats()
+	fmt.Printf("Noise: mean %f, stddev %f, max %d; %f of budget used\n",
+		stats.Mean, stats.Stddev, stats.Max, report.Budget())
+	if val != DB.GetElem(index) || stats.Count != DB.Info.Ne || report.ProbableFailure() {
+		panic("Failure")
+	}
+
+	row := index / p.M
+	answer.Data[0].AddAt(p.Delta()*9/20, row*DB.Info.Ne, 0)
+	_, report = pir.RecoverNoise(index, 0, offline, q, answer, shared, client, p, DB.Info)
+	if !report.ProbableFailure() {
+		panic("Noisy answer not flagged")
+	}
+}
+
+// Builds a random DB of records of d bits that exactly fills a DB of width m
+// (and height 8 records), with params picked for that shape.
+func correctnessDB(pi PIR, m, d uint64) (*Database, Params) {
+	p := pi.PickParamsGivenDimensions(1, m, SEC_PARAM, LOGQ)
+	_, ne, packing := Num_DB_entries(1, d, p.P)
+	if packing == 0 {
+		packing = 1
+	}
+	l := 8 * ne
+	p = pi.PickParamsGivenDimensions(l, m, SEC_PARAM, LOGQ)
+	N := (l / ne) * m * packing
+	return MakeRandomDB(N, d, &p), p
+}
+
+// Run thousands of random queries against each params row in params.csv (with
+// at most 2^LOG_M_MAX samples, default 2^13) and several record widths, and
+// check the failure rate and noise against the analytic bounds. DoublePIR's
+// queries are slower, so it makes a tenth as many. This takes minutes, so it
+// only runs with HARNESS_QUERIES set (e.g., to 1000).
+func TestCorrectnessHarness(t *testing.T) {
+	if os.Getenv("HARNESS_QUERIES") == "" {
+		t.Skip("set HARNESS_QUERIES to run the correctness harness")
+	}
+	log_m_max, err := strconv.Atoi(os.Getenv("LOG_M_MAX"))
+	if err != nil {
+		log_m_max = 13
+	}
+	num_queries, err := strconv.Atoi(os.Getenv("HARNESS_QUERIES"))
+	if err != nil {
+		num_queries = 1000
+	}
+
+	for _, l := range strings.Split(lwe_params, "\n")[1:] {
+		line := strings.Split(l, ",")
+		if len(line) < 7 {
+			continue
+		}
+		logn, _ := strconv.Atoi(line[0])
+		logm, _ := strconv.Atoi(line[1])
+		if (1<<logn) != SEC_PARAM || logm > log_m_max {
+			continue
+		}
+
+		for _, d := range []uint64{1, 8, 32} {
+			for _, pir := range []PIR{&SimplePIR{}, &DoublePIR{}} {
+				queries := uint64(num_queries)
+				if pir.Name() == "DoublePIR" {
+					queries /= 10
+				}
+				DB, p := correctnessDB(pir, 1<<logm, d)
+				r := MeasureCorrectness(pir, DB, p, queries)
+				fmt.Printf("%s, m=2^%d, p=%d, d=%d: %d/%d failures; noise stddev %f (bound %f, max %d); "+
+					"Pr[elem fails] <= %e; Gaussian stddev %f (sigma %f)\n",
+					r.Scheme, logm, p.P, d, r.Failures, r.Queries, r.Noise.Stddev, r.Bound,
+					r.Noise.Max, r.Elem_fail_prob, r.Gauss.Stddev, p.Sigma)
+
+				if r.Failures != 0 || r.Flagged != 0 {
+					panic("Decryption failures")
+				}
+				if r.Noise.Stddev > r.Bound || r.Elem_fail_prob > math.Pow(2, -40) {
+					panic("Noise exceeds analytic bound")
+				}
+				if r.Inner.Stddev > r.Inner_bound || r.Inner_fail_prob > math.Pow(2, -40) {
+					panic("Inner-layer noise exceeds analytic bound")
+				}
+				if math.Abs(r.Gauss.Stddev-p.Sigma) > 0.05*p.Sigma || math.Abs(r.Gauss.Mean) > 0.5 {
+					panic("Gaussian sampler does not match sigma")
+				}
+			}
+		}
+	}
+}
+
+// Test that switched answers unpack to within the rounding error of the
+// original elems, for moduli that do and do not divide 32 bits.
+func TestModSwitchPacking(t *testing.T) {
+	v := MatrixRand(1001, 1, LOGQ, 0)
+	for _, logq := range []uint64{8, 13, 16, 31, 32} {
+		p := Params{Logq: LOGQ, Logq_answer: logq}
+		packed := switchAnswer(v, p)
+		if packed.Rows != packedRows(v.Rows, logq) || checkAnswerVector(packed, v.Rows, p) != nil {
+			panic("Failure")
+		}
+
+		out := unswitchAnswer(packed, v.Rows, p)
+		for j := range v.Data {
+			diff := int64(int32(uint32(out.Data[j]) - uint32(v.Data[j])))
+			if diff < 0 {
+				diff = -diff
+			}
+			if uint64(diff) > (uint64(1)<<(LOGQ-logq))/2 {
+				panic("Failure")
+			}
+		}
+	}
+}
+
+// Test that switching answers to a smaller modulus shrinks them, and keeps
+// decoding correct and within the analytic noise bound.
+func TestSimplePirModSwitch(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	full := pir.GetBW(DB.Info, p)
+	pir.PickAnswerModulus(&p, DB.Info)
+	switched := pir.GetBW(DB.Info, p)
+	fmt.Printf("Answers switched to 2^%d: online download %f KB (was %f KB)\n",
+		p.Logq_answer, switched.Online_download, full.Online_download)
+	if p.Logq_answer == 0 || p.Logq_answer >= LOGQ || switched.Online_download >= full.Online_download {
+		panic("Failure")
+	}
+
+	RunPIR(&pir, DB, p, []uint64{262144, 0})
+
+	DB, p2 := correctnessDB(&pir, 1<<13, d)
+	p2.Logq_answer = p.Logq_answer
+	r := MeasureCorrectness(&pir, DB, p2, 100)
+	if r.Failures != 0 || r.Flagged != 0 || r.Noise.Stddev > r.Bound || r.Elem_fail_prob > math.Pow(2, -40) {
+		panic("Failure")
+	}
+}
+
+func TestDoublePirModSwitch(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := DoublePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	full := pir.GetBW(DB.Info, p)
+	pir.PickAnswerModulus(&p, DB.Info)
+	switched := pir.GetBW(DB.Info, p)
+	fmt.Printf("Answers switched to 2^%d: online download %f KB (was %f KB)\n",
+		p.Logq_answer, switched.Online_download, full.Online_download)
+	if p.Logq_answer == 0 || p.Logq_answer >= LOGQ || switched.Online_download >= full.Online_download {
+		panic("Failure")
+	}
+
+	RunPIR(&pir, DB, p, []uint64{0, 0})
+
+	DB, p2 := correctnessDB(&pir, 1<<13, d)
+	pir.PickAnswerModulus(&p2, DB.Info)
+	r := MeasureCorrectness(&pir, DB, p2, 10)
+	if r.Failures != 0 || r.Flagged != 0 || r.Inner.Stddev > r.Inner_bound ||
+		r.Inner_fail_prob > math.Pow(2, -40) {
+		panic("Failure")
+	}
+}
+
+// Test that, on a DB taller than the compressed hint, sending more raw columns
+// of the hint trades a larger hint for a smaller answer, from DoublePIR's costs
+// to SimplePIR's hint size, and that recovery is correct all along.
+func TestDoublePirRawHintCols(t *testing.T) {
+	d := uint64(8)
+	p := (&DoublePIR{}).PickParamsGivenDimensions(1<<13, 1<<9, SEC_PARAM, LOGQ)
+	_, ne, packing := Num_DB_entries(1, d, p.P)
+	N := p.L / ne * p.M * packing
+	DB := MakeRandomDB(N, d, &p)
+
+	var prev CostReport
+	for raw := uint64(0); raw <= p.N; raw += p.N / 4 {
+		pir := DoublePIR{Raw_hint_cols: raw}
+		c := pir.GetBW(DB.Info, p)
+		fmt.Printf("%d raw hint columns: hint %f KB, online download %f KB\n",
+			raw, c.Hint_size, c.Online_download)
+		if raw > 0 && (c.Hint_size <= prev.Hint_size || c.Online_download >= prev.Online_download) {
+			panic("Failure")
+		}
+		prev = c
+	}
+	if prev.Hint_size != (&SimplePIR{}).GetBW(DB.Info, p).Hint_size {
+		panic("Failure")
+	}
+
+	for _, raw := range []uint64{1, p.N / 2, p.N} {
+		pir := DoublePIR{Raw_hint_cols: raw}
+		DB := MakeRandomDB(N, d, &p)
+		RunPIR(&pir, DB, p, []uint64{12345, 54321})
+	}
+}
+
+// Test that a DB sharded row-wise across workers (into uneven shards, with a
+// batch whose slices span several of them) yields the same hint and answers
+// as the unsharded DB.
+func TestShardedSimplePir(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	server := NewShardedServer(ShardDB(DB, 5))
+	if server.Rows() != DB.Data.Rows {
+		panic("Failure")
+	}
+
+	num_queries := uint64(3)
+	batch_sz := DB.Data.Rows / (DB.Info.Ne * num_queries) * DB.Data.Cols
+	indexes := []uint64{123, batch_sz + 4567, 2*batch_sz + 89}
+	var expected []uint64
+	for _, i := range indexes {
+		expected = append(expected, DB.GetElem(i))
+	}
+
+	shared := pir.Init(DB.Info, p)
+	_, hint := pir.Setup(DB, shared, p)
+	sharded_hint, err := server.Setup(context.Background(), shared, p)
+	if err != nil || !reflect.DeepEqual(hint, sharded_hint) || server.Info != DB.Info {
+		panic("Failure")
+	}
+
+	var clients []State
+	var query MsgSlice
+	for _, i := range indexes {
+		client, q := pir.Query(i, shared, p, DB.Info)
+		clients = append(clients, client)
+		query.Data = append(query.Data, q)
+	}
+	answer := pir.Answer(DB, query, State{}, shared, p)
+	sharded, err := server.Answer(context.Background(), query, p)
+	if err != nil || !reflect.DeepEqual(answer, sharded) {
+		panic("Failure")
+	}
+	if err := pir.CheckAnswer(sharded, num_queries, p, DB.Info); err != nil {
+		panic(err)
+	}
+
+	for b, i := range indexes {
+		if pir.Recover(i, uint64(b), sharded_hint, query.Data[b], sharded, shared, clients[b],
+			p, DB.Info) != expected[b] {
+			panic("Failure")
+		}
+	}
+
+	if _, err := server.Answer(context.Background(), MsgSlice{}, p); !errors.Is(err, ErrMalformedQuery) {
+		panic("Failure")
+	}
+}
+
+// Test that a DB sharded column-wise across workers (into uneven shards)
+// yields the same hint and answers as the unsharded DB, while each worker
+// receives only its slice of each query.
+func TestColumnShardedSimplePir(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	workers := ColumnShardDB(DB, 5)
+	server := NewColumnShardedServer(workers)
+	if server.Cols() != DB.Data.Cols || workers[1].Cols() >= p.M/4 {
+		panic("Failure")
+	}
+
+	num_queries := uint64(2)
+	batch_sz := DB.Data.Rows / (DB.Info.Ne * num_queries) * DB.Data.Cols
+	indexes := []uint64{p.M - 1, batch_sz + 4567}
+	var expected []uint64
+	for _, i := range indexes {
+		expected = append(expected, DB.GetElem(i))
+	}
+
+	shared := pir.Init(DB.Info, p)
+	_, hint := pir.Setup(DB, shared, p)
+	sharded_hint, err := server.Setup(context.Background(), shared, p)
+	if err != nil || !reflect.DeepEqual(hint, sharded_hint) || server.Info != DB.Info {
+		panic("Failure")
+	}
+
+	var clients []State
+	var query MsgSlice
+	for _, i := range indexes {
+		client, q := pir.Query(i, shared, p, DB.Info)
+		clients = append(clients, client)
+		query.Data = append(query.Data, q)
+	}
+	answer := pir.Answer(DB, query, State{}, shared, p)
+	sharded, err := server.Answer(context.Background(), query, p)
+	if err != nil || !reflect.DeepEqual(answer, sharded) {
+		panic("Failure")
+	}
+
+	for b, i := range indexes {
+		if pir.Recover(i, uint64(b), sharded_hint, query.Data[b], sharded, shared, clients[b],
+			p, DB.Info) != expected[b] {
+			panic("Failure")
+		}
+	}
+
+	// a worker rejects a query slice that does not match its columns
+	_, err = workers[0].Answer(context.Background(), 0, 1, query.Data[0].Data[0])
+	if !errors.Is(err, ErrMalformedQuery) {
+		panic("Failure")
+	}
+}
+
+// A ShardWorker whose next setup fails, before it touches its block.
+type flakyShard struct {
+	ShardWorker
+	fail bool
+}
+
+func (s *flakyShard) Setup(ctx context.Context, shared State, p Params) (*Matrix, DBinfo, error) {
+	if s.fail {
+		s.fail = false
+		return nil, DBinfo{}, errors.New("worker down")
+	}
+	return s.ShardWorker.Setup(ctx, shared, p)
+}
+
+// Test that a sharded setup that fails, because it is canceled or because one
+// worker fails after the others are set up, can be retried.
+func TestShardedSetupRetry(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+	i := uint64(N - 5)
+	expected := DB.GetElem(i)
+
+	row_workers := ShardDB(DB, 3)
+	row_workers[1] = &flakyShard{row_workers[1], true}
+	col_workers := ColumnShardDB(DB, 3)
+	col_workers[1] = &flakyShard{col_workers[1], true}
+
+	shared := pir.Init(DB.Info, p)
+	_, hint := pir.Setup(DB, shared, p)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, server := range []interface {
+		Setup(context.Context, State, Params) (Msg, error)
+		Answer(context.Context, MsgSlice, Params) (Msg, error)
+	}{NewShardedServer(row_workers), NewColumnShardedServer(col_workers)} {
+		if _, err := server.Setup(context.Background(), shared, p); err == nil {
+			panic("Failure")
+		}
+		if _, err := server.Setup(canceled, shared, p); err == nil {
+			panic("Failure")
+		}
+		sharded_hint, err := server.Setup(context.Background(), shared, p)
+		if err != nil || !reflect.DeepEqual(hint, sharded_hint) {
+			panic("Failure")
+		}
+
+		client, q := pir.Query(i, shared, p, DB.Info)
+		answer, err := server.Answer(context.Background(), MakeMsgSlice(q), p)
+		if err != nil {
+			panic(err)
+		}
+		if pir.Recover(i, 0, sharded_hint, q, answer, shared, client, p, DB.Info) != expected {
+			panic("Failure")
+		}
+	}
+}
+
+// Test that RecoverChecked recovers from well-formed answers, and rejects
+// entries outside the slice of their query, and malformed answers.
+func TestRecoverChecked(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	for _, pi := range []PIR{&SimplePIR{}, &DoublePIR{}} {
+		p := pi.PickParams(N, d, SEC_PARAM, LOGQ)
+		DB := MakeRandomDB(N, d, &p)
+		half := p.L / 2 / DB.Info.Ne * p.M
+		indexes := []uint64{1, half + 2}
+		var expected []uint64
+		for _, i := range indexes {
+			expected = append(expected, DB.GetElem(i))
+		}
+
+		shared := pi.Init(DB.Info, p)
+		server, hint := pi.Setup(DB, shared, p)
+		var clients []State
+		var query MsgSlice
+		for _, i := range indexes {
+			client, q := pi.Query(i, shared, p, DB.Info)
+			clients = append(clients, client)
+			query.Data = append(query.Data, q)
+		}
+		answer := pi.Answer(DB, query, server, shared, p)
+		pi.Reset(DB, p)
+
+		for b, i := range indexes {
+			val, err := RecoverChecked(pi, i, uint64(b), 2, hint, query.Data[b], answer, shared, clients[b], p, DB.Info)
+			if err != nil || val != expected[b] {
+				panic(fmt.Sprintf("%s: reconstruct failed", pi.Name()))
+			}
+		}
+
+		// the entry of the other query, a query past the batch, an index past
+		// the DB, and a truncated answer
+		bad := []struct {
+			i, b, num uint64
+			answer    Msg
+			err       error
+		}{
+			{indexes[1], 0, 2, answer, ErrMalformedQuery},
+			{indexes[0], 2, 2, answer, ErrMalformedQuery},
+			{N, 1, 2, answer, ErrMalformedQuery},
+			{indexes[1], 1, 2, Msg{Data: answer.Data[:len(answer.Data)-1]}, ErrMalformedAnswer},
+		}
+		for _, c := range bad {
+			client := clients[c.b%2]
+			_, err := RecoverChecked(pi, c.i, c.b, c.num, hint, query.Data[c.b%2], c.answer, shared, client, p, DB.Info)
+			if !errors.Is(err, c.err) {
+				panic(fmt.Sprintf("%s: got error %v, want %v", pi.Name(), err, c.err))
+			}
+		}
+	}
+}
+
+// Test that MatrixRand samples in range, roughly uniformly, and as a fixed
+// function of the PRG stream regardless of how the matrix is split up.
+func TestMatrixRand(t *testing.T) {
+	seed := RandomPRGKey()
+	mod := uint64(991)
+
+	bufPrgReader = NewBufPRG(NewPRG(seed))
+	m := MatrixRand(1000, 1000, 0, mod)
+	q := MatrixRand(1024, 1024, 32, 0)
+
+	bufPrgReader = NewBufPRG(NewPRG(seed))
+	m1 := MatrixRand(123, 1000, 0, mod)
+	m2 := MatrixRand(877, 1000, 0, mod)
+	m1.Concat(m2)
+	if !reflect.DeepEqual(m, m1) || !reflect.DeepEqual(q, MatrixRand(1024, 1024, 32, 0)) {
+		panic("MatrixRand does not depend only on the PRG stream")
+	}
+	bufPrgReader = NewBufPRG(RandomPRG())
+
+	counts := make([]int, mod)
+	for i := uint64(0); i < m.Size(); i++ {
+		v := m.Get(i/m.Cols, i%m.Cols)
+		if v >= mod {
+			panic("Sample out of range")
+		}
+		counts[v] += 1
+	}
+	expected := float64(m.Size()) / float64(mod)
+	chi2 := float64(0)
+	for _, c := range counts {
+		chi2 += (float64(c) - expected) * (float64(c) - expected) / expected
+	}
+	// ~990 degrees of freedom: mean 990, stddev ~45
+	if chi2 > 990+6*45 {
+		panic("Samples not uniform")
+	}
+}
+
+// Test that the client expands a compressed state to the server's A under
+// each kind of PRG, and that the kinds expand the same seed differently.
+func TestSimplePirPRGKinds(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	seed := RandomPRGKey()
+	var expanded []*Matrix
+	for _, kind := range []PRGKind{AESCTR, SHAKE128, ChaCha20} {
+		server, comp := pir.InitCompressedSeededPRG(DB.Info, p, seed, kind)
+		if comp.PRG != kind {
+			panic("PRG not recorded in compressed state")
+		}
+		client := pir.DecompressState(DB.Info, p, comp)
+		if !reflect.DeepEqual(server.Data[0], client.Data[0]) {
+			panic(fmt.Sprintf("%s: client and server disagree on A", kind))
+		}
+		for _, A := range expanded {
+			if reflect.DeepEqual(A, server.Data[0]) {
+				panic("Different PRGs expanded seed identically")
+			}
+		}
+		expanded = append(expanded, server.Data[0])
+	}
+}
+
+// Test that two clients that expand the same (public) seed agree on the shared
+// state, but still sample different query secrets.
+func TestDecompressStateSecrets(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	for _, pi := range []PIR{&SimplePIR{}, &DoublePIR{}} {
+		p := pi.PickParams(N, d, SEC_PARAM, LOGQ)
+		DB := MakeRandomDB(N, d, &p)
+		shared, comp := pi.InitCompressed(DB.Info, p)
+		pi.Setup(DB, shared, p)
+
+		shared1 := pi.DecompressState(DB.Info, p, comp)
+		client1, _ := pi.Query(1, shared1, p, DB.Info)
+		shared2 := pi.DecompressState(DB.Info, p, comp)
+		client2, _ := pi.Query(1, shared2, p, DB.Info)
+		if !reflect.DeepEqual(shared1, shared2) || !reflect.DeepEqual(shared, shared1) {
+			panic(fmt.Sprintf("%s: clients disagree on the shared state", pi.Name()))
+		}
+		if reflect.DeepEqual(client1, client2) {
+			panic(fmt.Sprintf("%s: seed determines the query secrets", pi.Name()))
+		}
+	}
+}
+
+func TestSimplePirStreamed(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	DB := MakeRandomDB(N, d, &p)
+	RunPIRStreamed(&pir, DB, p, []uint64{0, 0, 0, 0})
+}
+
+func TestDoublePirStreamed(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := DoublePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	DB := MakeRandomDB(N, d, &p)
+	RunPIRStreamed(&pir, DB, p, []uint64{0, 0, 0, 0})
+}
+
+// Test that streamed setup computes the same hint as setup from the
+// decompressed shared state, so that the two modes interoperate.
+func TestStreamedSetupMatches(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	for _, pi := range []PIR{&SimplePIR{}, &DoublePIR{}} {
+		p := pi.PickParams(N, d, SEC_PARAM, LOGQ)
+		DB := MakeRandomDB(N, d, &p)
+
+		comp := MakeCompressedState(RandomPRGKey())
+		comp.PRG = SHAKE128
+		shared := pi.DecompressState(DB.Info, p, comp)
+		server, hint := pi.Setup(DB, shared, p)
+		pi.Reset(DB, p)
+
+		server_streamed, hint_streamed := pi.SetupStreamed(DB, comp, p)
+		pi.Reset(DB, p)
+		if !reflect.DeepEqual(hint, hint_streamed) || !reflect.DeepEqual(server, server_streamed) {
+			panic(fmt.Sprintf("%s: streamed setup disagrees", pi.Name()))
+		}
+	}
+}
+
+// Test that queries taken from a query pool (including one that was written
+// out and read back) are answered correctly, and that the pool runs dry.
+func TestSimplePirQueryPool(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	shared := pir.Init(DB.Info, p)
+	digest := DigestSharedState(shared)
+	server, hint := pir.Setup(DB, shared, p)
+	pool := pir.NewQueryPool(shared, p, DB.Info, 4)
+
+	var buf bytes.Buffer
+	if _, err := pool.WriteTo(&buf); err != nil {
+		panic(err)
+	}
+	saved, err := ReadQueryPool(&buf, digest, p, DB.Info)
+	if err != nil || saved.Len() != 4 {
+		panic("Failure")
+	}
+	if _, err := ReadQueryPool(bytes.NewReader([]byte("garbage!")), digest, p, DB.Info); !errors.Is(err, ErrMalformedPool) {
+		panic("Failure")
+	}
+
+	// headers claiming huge or foreign dimensions, or more queries than
+	// follow, are rejected
+	var small bytes.Buffer
+	pir.NewQueryPool(shared, p, DB.Info, 1).WriteTo(&small)
+	for _, field := range []int{0, 1, 2, 3} {
+		bad := append([]byte{}, small.Bytes()...)
+		binary.LittleEndian.PutUint64(bad[8+8*field:], 1<<62)
+		if _, err := ReadQueryPool(bytes.NewReader(bad), digest, p, DB.Info); err == nil {
+			panic("Failure")
+		}
+	}
+	q := p
+	q.N *= 2
+	if _, err := ReadQueryPool(bytes.NewReader(small.Bytes()), digest, q, DB.Info); !errors.Is(err, ErrMalformedPool) {
+		panic("Failure")
+	}
+	if _, _, err := pir.QueryFromPool(0, pool, digest, q, DB.Info); !errors.Is(err, ErrMalformedPool) {
+		panic("Failure")
+	}
+
+	// as are pools built for another shared state (A), in memory or on disk
+	other := pir.Init(DB.Info, p)
+	other_digest := DigestSharedState(other)
+	if _, err := ReadQueryPool(bytes.NewReader(small.Bytes()), other_digest, p, DB.Info); !errors.Is(err, ErrMalformedPool) {
+		panic("Failure")
+	}
+	if _, _, err := pir.QueryFromPool(0, pool, other_digest, p, DB.Info); !errors.Is(err, ErrMalformedPool) {
+		panic("Failure")
+	}
+	if err := pir.RefillQueryPool(pool, other, p, DB.Info, 5); !errors.Is(err, ErrMalformedPool) {
+		panic("Failure")
+	}
+	if err := NewQueryManager(&pir, other, p, DB.Info).UsePool(pool); !errors.Is(err, ErrMalformedPool) {
+		panic("Failure")
+	}
+	if pool.Len() != 4 {
+		panic("Failure")
+	}
+
+	for _, pl := range []*QueryPool{pool, saved} {
+		for _, i := range []uint64{0, 1, N / 2, N - 1} {
+			client, query, err := pir.QueryFromPool(i, pl, digest, p, DB.Info)
+			if err != nil {
+				panic(err)
+			}
+			answer := pir.Answer(DB, MakeMsgSlice(query), server, shared, p)
+			pir.Reset(DB, p)
+			if pir.Recover(i, 0, hint, query, answer, shared, client, p, DB.Info) != DB.GetElem(i) {
+				panic("Failure")
+			}
+			DB.Data.Add(p.P / 2)
+			DB.Squish()
+		}
+		if _, _, err := pir.QueryFromPool(0, pl, digest, p, DB.Info); err != ErrPoolEmpty {
+			panic("Failure")
+		}
+	}
+
+	if err := pir.RefillQueryPool(pool, shared, p, DB.Info, 2); err != nil || pool.Len() != 2 {
+		panic("Failure")
+	}
+}
+
+// Test that the query manager never issues a pooled secret twice, falls back
+// to online queries when the pool runs dry, and recovers once per state.
+func TestQueryManager(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := SimplePIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	shared := pir.Init(DB.Info, p)
+	server, hint := pir.Setup(DB, shared, p)
+
+	// the same pool, restored twice
+	var buf bytes.Buffer
+	pir.NewQueryPool(shared, p, DB.Info, 2).WriteTo(&buf)
+	saved := buf.Bytes()
+	pool1, _ := ReadQueryPool(bytes.NewReader(saved), DigestSharedState(shared), p, DB.Info)
+	pool2, _ := ReadQueryPool(bytes.NewReader(saved), DigestSharedState(shared), p, DB.Info)
+
+	m := NewQueryManager(&pir, shared, p, DB.Info)
+	if err := m.UsePool(pool1); err != nil {
+		panic(err)
+	}
+	var clients []State
+	var queries []Msg
+	for j := 0; j < 3; j++ {
+		if j == 2 {
+			// every entry is a reused secret, so this query is built online
+			if err := m.UsePool(pool2); err != nil {
+				panic(err)
+			}
+		}
+		c, q := m.Query(uint64(j))
+		clients = append(clients, c)
+		queries = append(queries, q)
+	}
+	if pool1.Len() != 0 || pool2.Len() != 0 || m.Outstanding() != 3 {
+		panic("Failure")
+	}
+	for j := range clients {
+		for k := 0; k < j; k++ {
+			if reflect.DeepEqual(clients[j], clients[k]) {
+				panic("Secret reused")
+			}
+		}
+	}
+
+	for j, q := range queries {
+		answer := pir.Answer(DB, MakeMsgSlice(q), server, shared, p)
+		pir.Reset(DB, p)
+		val, err := m.Recover(uint64(j), 0, 1, hint, q, answer, clients[j])
+		if err != nil || val != DB.GetElem(uint64(j)) {
+			panic("Failure")
+		}
+		if _, err := m.Recover(uint64(j), 0, 1, hint, q, answer, clients[j]); err != ErrStateUsed {
+			panic("Failure")
+		}
+		DB.Data.Add(p.P / 2)
+		DB.Squish()
+	}
+	if _, err := m.Recover(0, 0, 1, hint, queries[0], Msg{}, MakeState(MatrixRand(p.N, 1, p.Logq, 0))); err != ErrUnknownState {
+		panic("Failure")
+	}
+	if m.Outstanding() != 0 {
+		panic("Failure")
+	}
+}
+
+// A DoublePIR whose second query reuses the secret1 of the first.
+type reusingPIR struct {
+	DoublePIR
+	first   *Matrix
+	queries int
+}
+
+func (pi *reusingPIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg) {
+	client, query := pi.DoublePIR.Query(i, shared, p, info)
+	pi.queries += 1
+	if pi.queries == 1 {
+		pi.first = client.Data[0]
+	} else if pi.queries == 2 {
+		client.Data[0] = pi.first
+	}
+	return client, query
+}
+
+// Test that the query manager refuses a client State that reuses one secret
+// of an earlier State, even with fresh other secrets.
+func TestQueryManagerSecretReuse(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := reusingPIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+	shared := pir.Init(DB.Info, p)
+	pir.Setup(DB, shared, p)
+
+	m := NewQueryManager(&pir, shared, p, DB.Info)
+	c1, _ := m.Query(1)
+	c2, _ := m.Query(2)
+	if pir.queries != 3 || reflect.DeepEqual(c1.Data[0], c2.Data[0]) || m.Outstanding() != 2 {
+		panic("Failure")
+	}
+}
+
+// Test that a batch of arbitrary (colliding, and repeated) indexes is
+// recovered in one round, under both schemes.
+func TestBatchPIR(t *testing.T) {
+	Num := uint64(1 << 14)
+	d := uint64(8)
+	k := uint64(32)
+	for _, pi := range []PIR{&SimplePIR{}, &DoublePIR{}} {
+		b := NewBatchPIR(pi, Num, d, k, RandomPRGKey(), SEC_PARAM, LOGQ)
+
+		rand := MathRand()
+		vals := make([]uint64, Num)
+		for i := range vals {
+			vals[i] = uint64(rand.Intn(1 << d))
+		}
+		DBs := b.MakeDBs(vals)
+
+		// neighboring indexes, which the row-sliced batch mode cannot serve, plus a repeat
+		indexes := []uint64{Num - 1}
+		for i := uint64(0); i < k-1; i++ {
+			indexes = append(indexes, i)
+		}
+		indexes[k-1] = indexes[0]
+
+		shared := b.Init()
+		servers, hints := b.Setup(DBs, shared)
+		st, query, err := b.Query(indexes, shared)
+		if err != nil {
+			panic(err)
+		}
+		if uint64(len(query.Data)) != b.Num_buckets {
+			panic("Failure")
+		}
+		answer, err := b.Answer(DBs, query, servers, shared)
+		if err != nil {
+			panic(err)
+		}
+
+		// queries, DBs and server states for the wrong number of buckets are
+		// rejected rather than answered in part
+		if _, err := b.Answer(DBs, MsgSlice{Data: query.Data[1:]}, servers, shared); !errors.Is(err, ErrMalformedQuery) {
+			panic("Failure")
+		}
+		if _, err := b.Answer(DBs[1:], query, servers, shared); err == nil {
+			panic("Failure")
+		}
+		if _, err := b.Answer(DBs, query, servers[1:], shared); err == nil {
+			panic("Failure")
+		}
+		b.Reset(DBs)
+
+		recovered, err := b.Recover(st, hints, query, answer, shared)
+		if err != nil {
+			panic(err)
+		}
+		for j, val := range recovered {
+			if val != vals[indexes[j]] {
+				panic(fmt.Sprintf("%s: reconstruct failed for index %d", pi.Name(), indexes[j]))
+			}
+		}
+		if _, err := b.Recover(st, hints, query, MsgSlice{Data: answer.Data[:1]}, shared); !errors.Is(err, ErrMalformedAnswer) {
+			panic("Failure")
+		}
+	}
+}
+
+// Test that batches of distinct random indexes always cuckoo-hash, for small
+// batch sizes too, and that the number of buckets bounds the failure
+// probability by 2^-40.
+func TestBatchPIRFailureRate(t *testing.T) {
+	Num := uint64(1 << 12)
+	rand := MathRand()
+	for _, k := range []uint64{1, 2, 4, 8, 16, 64, 1024} {
+		b := NewBatchPIR(&SimplePIR{}, Num, 8, k, RandomPRGKey(), SEC_PARAM, LOGQ)
+		if cuckooFailureBound(k, b.Num_buckets) > math.Exp2(-40) ||
+			float64(b.Num_buckets) < CuckooExpansion*float64(k) {
+			panic("Failure")
+		}
+		if k > 64 {
+			continue
+		}
+
+		for trial := 0; trial < 20000; trial++ {
+			var indexes []uint64
+			seen := make(map[uint64]bool)
+			for uint64(len(indexes)) < k {
+				i := uint64(rand.Intn(int(Num)))
+				if !seen[i] {
+					seen[i] = true
+					indexes = append(indexes, i)
+				}
+			}
+			entries, err := b.place(indexes)
+			if err != nil {
+				panic(fmt.Sprintf("k = %d: %v", k, err))
+			}
+			placed := 0
+			for bkt, i := range entries {
+				if i >= 0 {
+					b.position(uint64(bkt), uint64(i))
+					placed++
+				}
+			}
+			if placed != int(k) {
+				panic("Failure")
+			}
+		}
+	}
+
+	// with 1.5 buckets per index, small batches fail far too often
+	if cuckooFailureBound(4, 6) < math.Exp2(-20) {
+		panic("Failure")
+	}
+}
+
+func TestTwoServerPir(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := TwoServerPIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	DB := MakeRandomDB(N, d, &p)
+	RunPIR(&pir, DB, p, []uint64{131072, 0, 0, 0})
+}
+
+func TestTwoServerPirLongRow(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(32)
+	pir := TwoServerPIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+
+	DB := MakeRandomDB(N, d, &p)
+	RunPIR(&pir, DB, p, []uint64{1})
+}
+
+// Test that two servers, each answering only its own query, serve a Database
+// that was built for SimplePIR.
+func TestTwoServerPirSharedDB(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	simple := SimplePIR{}
+	p := simple.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	pir := TwoServerPIR{}
+	server, hint := pir.Setup(DB, State{}, p)
+	for _, i := range []uint64{0, 1, N / 3, N - 1} {
+		client, query := pir.Query(i, State{}, p, DB.Info)
+		if !reflect.DeepEqual(pir.SplitQuery(query, 0), MakeMsg(query.Data[0])) {
+			panic("Failure")
+		}
+		ansA := pir.Answer(DB, MakeMsgSlice(pir.SplitQuery(query, 0)), server, State{}, p)
+		ansB := pir.Answer(DB, MakeMsgSlice(pir.SplitQuery(query, 1)), server, State{}, p)
+		answer := pir.JoinAnswers(ansA, ansB)
+		if err := pir.CheckAnswer(answer, 1, p, DB.Info); err != nil {
+			panic(err)
+		}
+		val := pir.Recover(i, 0, hint, query, answer, State{}, client, p, DB.Info)
+		pir.Reset(DB, p)
+		if val != DB.GetElem(i) {
+			panic("Failure")
+		}
+		DB.Data.Add(p.P / 2)
+		DB.Squish()
+	}
+}
+
+// Test that FrodoPIR recovers preprocessed queries without the hint, falls back
+// to online queries when a client runs out of them, and keeps the preprocessed
+// queries of each client apart.
+func TestFrodoPir(t *testing.T) {
+	N := uint64(1 << 20)
+	d := uint64(8)
+	pir := FrodoPIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	shared, comp := pir.InitCompressed(DB.Info, p)
+	server, hint := pir.Setup(DB, shared, p)
+	pre := pir.Preprocess(hint, comp, p, DB.Info, 3)
+	other := pir.Preprocess(hint, comp, p, DB.Info, 2)
+	if PendingFrodoQueries(pre) != 3 || PendingFrodoQueries(other) != 2 {
+		panic("Failure")
+	}
+
+	for j, i := range []uint64{0, N / 2, N - 1, 7} {
+		client, query := pir.QueryPreprocessed(i, &pre, comp, p, DB.Info)
+		if (j < 3) != (len(client.Data) == 2) {
+			panic("Failure")
+		}
+		answer := pir.Answer(DB, MakeMsgSlice(query), server, shared, p)
+		pir.Reset(DB, p)
+
+		var val uint64
+		if j < 3 {
+			val = pir.Recover(i, 0, Msg{}, query, answer, State{}, client, p, DB.Info)
+		} else {
+			val = pir.Recover(i, 0, hint, query, answer, State{}, client, p, DB.Info)
+		}
+		if val != DB.GetElem(i) {
+			panic("Failure")
+		}
+		DB.Data.Add(p.P / 2)
+		DB.Squish()
+	}
+	pir.Reset(DB, p)
+	if PendingFrodoQueries(pre) != 0 || PendingFrodoQueries(other) != 2 {
+		panic("Failure")
+	}
+
+	RunPIR(&pir, DB, p, []uint64{0, 0})
+}
+
+// Test that a product of an RLWE ciphertext with a plaintext decrypts to the
+// product of the plaintexts mod 2^32.
+func TestRLWEPlaintextMul(t *testing.T) {
+	rand := MathRand()
+	z := rlweRing.TernaryPoly(randBytesReader{})
+	rlweRing.NTT(z)
+
+	msg := make([]uint64, rlweN)
+	for j := range msg {
+		msg[j] = uint64(rand.Uint32())
+	}
+	a := rlweRing.UniformPoly(randBytesReader{})
+	b := rlweEncrypt(z, a, msg)
+
+	plain := rlweRing.NewPoly()
+	rlweRing.SetCoeff(plain, 0, 3)
+	rlweRing.SetCoeff(plain, 1, -(1 << 15))
+	rlweRing.NTT(plain)
+
+	rlweRing.NTT(a)
+	rlweRing.MulCoeffs(a, plain, a)
+	rlweRing.MulCoeffs(a, z, a)
+	rlweRing.INTT(a)
+	rlweRing.NTT(b)
+	rlweRing.MulCoeffs(b, plain, b)
+	rlweRing.INTT(b)
+	rlweRing.Add(a, b, a)
+
+	for j := uint64(0); j < rlweN; j++ {
+		// msg * (3 - 2^15 X), negacyclically
+		want := 3 * msg[j]
+		if j > 0 {
+			want -= msg[j-1] << 15
+		} else {
+			want += msg[rlweN-1] << 15
+		}
+		if rlweDecode(a.Coeffs[0][j], a.Coeffs[1][j]) != want%(1<<32) {
+			panic("Failure")
+		}
+	}
+}
+
+func TestHintlessPir(t *testing.T) {
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := HintlessPIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+
+	if c := pir.GetBW(DB.Info, p); c.Offline_download != 0 || c.Hint_size != 0 {
+		panic("Failure")
+	}
+
+	RunPIR(&pir, DB, p, []uint64{0, N / 3})
+	RunPIRStreamed(&pir, DB, p, []uint64{N - 1})
+}
+
+// Test that HintlessPIR counts each answer once, under its own label, and only
+// once the answer is computed.
+func TestHintlessPirMetrics(t *testing.T) {
+	reg := NewRegistry()
+	SetMetrics(reg)
+	defer SetMetrics(nil)
+
+	N := uint64(1 << 16)
+	d := uint64(8)
+	pir := HintlessPIR{}
+	p := pir.PickParams(N, d, SEC_PARAM, LOGQ)
+	DB := MakeRandomDB(N, d, &p)
+	RunPIR(&pir, DB, p, []uint64{1, 2})
+
+	if reg.Counter(MetricQueriesAnswered, "scheme", "HintlessPIR") != 2 ||
+		reg.Counter(MetricBytesScanned, "scheme", "HintlessPIR") == 0 ||
+		reg.Counter(MetricQueriesAnswered, "scheme", "SimplePIR") != 0 ||
+		reg.Counter(MetricBytesScanned, "scheme", "SimplePIR") != 0 {
+		panic("Failure")
+	}
+	if count, _ := reg.Histogram(MetricAnswerSeconds, "scheme", "HintlessPIR"); count != 1 {
+		panic("Failure")
+	}
+	if count, _ := reg.Histogram(MetricAnswerSeconds, "scheme", "SimplePIR"); count != 0 {
+		panic("Failure")
+	}
+
+	shared := pir.Init(DB.Info, p)
+	server, _ := pir.Setup(DB, shared, p)
+	_, q := pir.Query(1, shared, p, DB.Info)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pir.AnswerCtx(canceled, DB, MakeMsgSlice(q), server, shared, p); err != context.Canceled {
+		panic("Failure")
+	}
+	if reg.Counter(MetricQueriesAnswered, "scheme", "HintlessPIR") != 2 {
+		panic("Failure")
+	}
+}
@@ -0,0 +1,217 @@
+package pir
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Query preprocessing for SimplePIR. Everything in a query except the Delta
+// added at the queried index -- the secret s, the error e, and A*s + e -- is
+// independent of the index, so the client can build a pool of these offline.
+// Answering a query from the pool then takes a single addition.
+//
+// A pool holds LWE secrets: keep persisted pools as private as the client
+// state, and never use a pool entry twice. Its queries are only valid for the
+// shared state (A) it was built for, which it records by digest: a pool kept
+// across a change of A is rejected rather than yielding wrong records.
+
+var ErrPoolEmpty = errors.New("pir: query pool is empty")
+var ErrMalformedPool = errors.New("pir: malformed query pool")
+
+const poolMagic = uint32(0x51505053) // "SPPQ"
+const poolVersion = uint32(2)
+
+// Length of a query vector padded to the compressed DB.
+func poolRows(p Params, info DBinfo) uint64 {
+	return (p.M + info.Squishing - 1) / info.Squishing * info.Squishing
+}
+
+// Identifies a shared state. Computing it takes a pass over A, so compute it
+// once per shared state, with DigestSharedState.
+type SharedDigest [sha256.Size]byte
+
+func DigestSharedState(shared State) SharedDigest {
+	return SharedDigest(digestState(shared))
+}
+
+type pooledQuery struct {
+	secret *Matrix // N x 1
+	query  *Matrix // A*s + e, padded to the compressed DB
+}
+
+// A pool of precomputed SimplePIR queries, built for one shared state (A),
+// Params and DBinfo. It is safe for concurrent use.
+type QueryPool struct {
+	N      uint64 // length of the secrets
+	Rows   uint64 // length of the (padded) query vectors
+	Logq   uint64
+	Shared SharedDigest
+
+	mu      sync.Mutex
+	entries []pooledQuery
+}
+
+// Returns a pool of size precomputed queries.
+func (pi *SimplePIR) NewQueryPool(shared State, p Params, info DBinfo, size uint64) *QueryPool {
+	pool := &QueryPool{N: p.N, Rows: poolRows(p, info), Logq: p.Logq, Shared: DigestSharedState(shared)}
+	if err := pi.RefillQueryPool(pool, shared, p, info, size); err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// Returns an error unless pool was built for shared and p and info.
+func (pool *QueryPool) check(shared SharedDigest, p Params, info DBinfo) error {
+	if pool.N != p.N || pool.Logq != p.Logq || pool.Rows != poolRows(p, info) {
+		return fmt.Errorf("%w: built for other parameters", ErrMalformedPool)
+	}
+	if pool.Shared != shared {
+		return fmt.Errorf("%w: built for another shared state", ErrMalformedPool)
+	}
+	return nil
+}
+
+// Precomputes queries until pool holds size of them. Returns an error if pool
+// was built for another shared state or other parameters.
+func (pi *SimplePIR) RefillQueryPool(pool *QueryPool, shared State, p Params, info DBinfo, size uint64) error {
+	if err := pool.check(DigestSharedState(shared), p, info); err != nil {
+		return err
+	}
+	A := shared.Data[0]
+	for uint64(pool.Len()) < size {
+		secret := MatrixRand(p.N, 1, p.Logq, 0)
+		err := MatrixGaussian(p.M, 1)
+		query := MatrixMul(A, secret)
+		query.MatrixAdd(err)
+		if p.M%info.Squishing != 0 {
+			query.AppendZeros(info.Squishing - (p.M % info.Squishing))
+		}
+
+		pool.mu.Lock()
+		pool.entries = append(pool.entries, pooledQuery{secret, query})
+		pool.mu.Unlock()
+	}
+	return nil
+}
+
+// Returns the number of unused queries in the pool.
+func (pool *QueryPool) Len() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return len(pool.entries)
+}
+
+func (pool *QueryPool) pop() (pooledQuery, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	n := len(pool.entries)
+	if n == 0 {
+		return pooledQuery{}, false
+	}
+	e := pool.entries[n-1]
+	pool.entries[n-1] = pooledQuery{}
+	pool.entries = pool.entries[:n-1]
+	return e, true
+}
+
+// Like Query, but takes the index-independent part of the query from pool,
+// and removes it from the pool. Returns ErrPoolEmpty if the pool is empty, and
+// ErrMalformedPool if it was not built for the shared state with digest shared,
+// or for p and info.
+func (pi *SimplePIR) QueryFromPool(i uint64, pool *QueryPool, shared SharedDigest, p Params,
+	info DBinfo) (State, Msg, error) {
+	defer observeSince(MetricQuerySeconds, pi.Name(), time.Now())
+
+	if err := pool.check(shared, p, info); err != nil {
+		return State{}, Msg{}, err
+	}
+	e, ok := pool.pop()
+	if !ok {
+		return State{}, Msg{}, ErrPoolEmpty
+	}
+	metrics.AddCounter(MetricQueriesBuilt, 1, "scheme", pi.Name())
+
+	e.query.AddAt(p.Delta(), info.elemIndex(i)%p.M, 0)
+	return MakeState(e.secret), MakeMsg(e.query), nil
+}
+
+// Writes the unused queries in the pool to w.
+func (pool *QueryPool) WriteTo(w io.Writer) (int64, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	header := []uint64{pool.N, pool.Rows, pool.Logq, uint64(len(pool.entries))}
+	if err := binary.Write(cw, binary.LittleEndian, []uint32{poolMagic, poolVersion}); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, header); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, pool.Shared); err != nil {
+		return cw.n, err
+	}
+	for _, e := range pool.entries {
+		if err := binary.Write(cw, binary.LittleEndian, e.secret.Data); err != nil {
+			return cw.n, err
+		}
+		if err := binary.Write(cw, binary.LittleEndian, e.query.Data); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// Reads a pool written by WriteTo, which must have been built for the shared
+// state with digest shared, and for p and info. Queries are allocated only as
+// they are read, so a header that claims more queries than r holds yields an
+// error rather than a large allocation.
+func ReadQueryPool(r io.Reader, shared SharedDigest, p Params, info DBinfo) (*QueryPool, error) {
+	var magic [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic[0] != poolMagic || magic[1] != poolVersion {
+		return nil, fmt.Errorf("%w: bad header", ErrMalformedPool)
+	}
+
+	var header [4]uint64
+	if err := binary.Read(r, binary.LittleEndian, header[:]); err != nil {
+		return nil, err
+	}
+	pool := &QueryPool{N: header[0], Rows: header[1], Logq: header[2]}
+	if err := binary.Read(r, binary.LittleEndian, &pool.Shared); err != nil {
+		return nil, err
+	}
+	if err := pool.check(shared, p, info); err != nil {
+		return nil, err
+	}
+
+	for j := uint64(0); j < header[3]; j++ {
+		e := pooledQuery{MatrixNew(pool.N, 1), MatrixNew(pool.Rows, 1)}
+		if err := binary.Read(r, binary.LittleEndian, e.secret.Data); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, e.query.Data); err != nil {
+			return nil, err
+		}
+		pool.entries = append(pool.entries, e)
+	}
+	return pool, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
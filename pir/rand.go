@@ -25,10 +25,14 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math/big"
 	mrand "math/rand"
 	"sync"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/sha3"
 )
 
 type PRGKey [aes.BlockSize]byte
@@ -46,6 +50,15 @@ func RandInt(mod *big.Int) *big.Int {
 	return out
 }
 
+// Fills buf with pseudo-random bytes, in one read from the PRG.
+func RandBytes(buf []byte) {
+	prgMutex.Lock()
+	defer prgMutex.Unlock()
+	if _, err := io.ReadFull(bufPrgReader.stream, buf); err != nil {
+		panic("Should never get here")
+	}
+}
+
 func MathRand() *mrand.Rand {
 	return mrand.New(bufPrgReader)
 }
@@ -98,14 +111,14 @@ func RandomPRG() *PRGReader {
 	return NewPRG(RandomPRGKey())
 }
 
+// Writes the next len(p) bytes of the AES-CTR keystream to p. The output
+// depends only on the key and on how many bytes were read before, and not on
+// the previous contents of p or on how reads are split up.
 func (s *PRGReader) Read(p []byte) (int, error) {
-	if len(p) < aes.BlockSize {
-		var buf [aes.BlockSize]byte
-		s.stream.XORKeyStream(buf[:], buf[:])
-		copy(p[:], buf[:])
-	} else {
-		s.stream.XORKeyStream(p, p)
+	for i := range p {
+		p[i] = 0
 	}
+	s.stream.XORKeyStream(p, p)
 	return len(p), nil
 }
 
@@ -116,6 +129,69 @@ func NewBufPRG(prg *PRGReader) *BufPRGReader {
 	return out
 }
 
+// The PRGs that a seed can be expanded with. The choice is recorded in
+// CompressedState, so that the client expands the seed the same way.
+type PRGKind uint8
+
+const (
+	AESCTR   PRGKind = iota // AES-128 in counter mode, with a zero IV
+	SHAKE128                // the SHAKE128 XOF, absorbing the seed
+	ChaCha20                // ChaCha20 keyed with the seed (zero-padded to 32 bytes), with a zero nonce
+)
+
+func (k PRGKind) String() string {
+	switch k {
+	case AESCTR:
+		return "AES-CTR"
+	case SHAKE128:
+		return "SHAKE128"
+	case ChaCha20:
+		return "ChaCha20"
+	}
+	return fmt.Sprintf("PRGKind(%d)", uint8(k))
+}
+
+// Returns the stream of pseudo-random bytes that key expands to under kind.
+func NewPRGOfKind(kind PRGKind, key *PRGKey) io.Reader {
+	switch kind {
+	case AESCTR:
+		return NewPRG(key)
+	case SHAKE128:
+		h := sha3.NewShake128()
+		h.Write(key[:])
+		return h
+	case ChaCha20:
+		var k [chacha20.KeySize]byte
+		var nonce [chacha20.NonceSize]byte
+		copy(k[:], key[:])
+		c, err := chacha20.NewUnauthenticatedCipher(k[:], nonce[:])
+		if err != nil {
+			panic(err)
+		}
+		return &chachaReader{c}
+	}
+	panic("Unknown PRG")
+}
+
+type chachaReader struct {
+	c *chacha20.Cipher
+}
+
+func (r *chachaReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.c.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+func NewBufPRGOfKind(kind PRGKind, key *PRGKey) *BufPRGReader {
+	out := new(BufPRGReader)
+	out.Key = *key
+	out.stream = bufio.NewReaderSize(NewPRGOfKind(kind, key), bufSize)
+	return out
+}
+
 func (b *BufPRGReader) RandInt(mod *big.Int) *big.Int {
 	out, err := rand.Int(b.stream, mod)
 	if err != nil {
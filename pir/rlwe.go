@@ -0,0 +1,109 @@
+package pir
+
+import (
+	"bufio"
+	"io"
+	"math/big"
+	"math/bits"
+
+	"github.com/ahenzinger/simplepir/ring"
+)
+
+// The ring-LWE layer of HintlessPIR: BFV-style encryption in
+// R_Q = Z_Q[X]/(X^n + 1) (see package ring), with plaintext modulus t = 2^32,
+// so that products with plaintext polynomials are computed mod 2^32, like
+// SimplePIR's.
+//
+// Q = q_0 * q_1 is the product of two 31-bit NTT-friendly primes whose product
+// is 1 mod t. This makes the BFV scaling Delta = (Q-1)/t exact up to 1, so that
+// the error of a product with a plaintext grows with the norm of the plaintext
+// only, and not with t. Residues fit in an Elem, so polynomials travel as
+// matrices with one row per prime.
+//
+// With n = 4096, log Q = 62 and ternary secrets, the RLWE instance is well
+// within the 128-bit security bounds of the homomorphic encryption standard.
+
+const rlweLogN = 12
+const rlweN = uint64(1) << rlweLogN
+
+var rlweModuli = []uint64{2140200961, 1148133377}
+var rlweRing = ring.NewRing(rlweLogN, rlweModuli)
+
+const rlweNumModuli = 2
+
+// The error is centered binomial with parameter rlweEta (stddev ~3.2).
+const rlweEta = 21
+
+// Q, and Delta = floor(Q / 2^32)
+var rlweQ = rlweModuli[0] * rlweModuli[1]
+var rlweDelta = rlweQ >> 32
+
+// q_1^-1 mod q_0, for CRT reconstruction
+var rlweCRT = new(big.Int).ModInverse(new(big.Int).SetUint64(rlweModuli[1]),
+	new(big.Int).SetUint64(rlweModuli[0])).Uint64()
+
+// An io.Reader over the global PRG, for sampling with package ring.
+type randBytesReader struct{}
+
+func (randBytesReader) Read(buf []byte) (int, error) {
+	RandBytes(buf)
+	return len(buf), nil
+}
+
+// Returns a reader of the PRG seeded with seed, from which both parties
+// regenerate the random parts of seeded ciphertexts.
+func rlweSeededReader(seed *PRGKey) io.Reader {
+	return bufio.NewReaderSize(NewPRGOfKind(AESCTR, seed), bufSize)
+}
+
+// Writes the residues of p mod each prime to consecutive rows of m, starting
+// at row.
+func polyToRows(p *ring.Poly, m *Matrix, row uint64) {
+	for i, res := range p.Coeffs {
+		m.setRow(row+uint64(i), res)
+	}
+}
+
+// Reads a polynomial written by polyToRows.
+func polyFromRows(m *Matrix, row uint64) *ring.Poly {
+	p := rlweRing.NewPoly()
+	for i, res := range p.Coeffs {
+		m.getRow(row+uint64(i), res)
+	}
+	return p
+}
+
+// Returns the body b = -a*z + e + Delta*msg of an encryption of msg (whose
+// coefficients are mod 2^32), given the secret z in NTT form and the uniform
+// random part a in coefficient form. The ciphertext is (a, b).
+func rlweEncrypt(z *ring.Poly, a *ring.Poly, msg []uint64) *ring.Poly {
+	b := a.Copy()
+	rlweRing.NTT(b)
+	rlweRing.MulCoeffs(b, z, b)
+	rlweRing.INTT(b)
+	rlweRing.Neg(b, b)
+	rlweRing.Add(b, rlweRing.CBDPoly(randBytesReader{}, rlweEta), b)
+
+	m := rlweRing.NewPoly()
+	for i, q := range rlweModuli {
+		delta := rlweDelta % q
+		for j, v := range msg {
+			m.Coeffs[i][j] = delta * (v % q) % q
+		}
+	}
+	rlweRing.Add(b, m, b)
+	return b
+}
+
+// Returns the message mod 2^32 in a coefficient of b + a*z, given the residues
+// of that coefficient: rounds 2^32 * x / Q, where x is reconstructed from its
+// residues by CRT.
+func rlweDecode(r0, r1 uint64) uint64 {
+	q0, q1 := rlweModuli[0], rlweModuli[1]
+	x := r1 + q1*(((r0+q0-r1%q0)%q0)*rlweCRT%q0)
+
+	hi, lo := bits.Mul64(x, 1<<32)
+	lo, carry := bits.Add64(lo, rlweQ/2, 0)
+	quo, _ := bits.Div64(hi+carry, lo, rlweQ)
+	return quo % (1 << 32)
+}
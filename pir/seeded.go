@@ -0,0 +1,89 @@
+package pir
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// Streaming access to the shared matrices (A for SimplePIR; A1, A2 for
+// DoublePIR) when they are expanded from a seed, as with InitCompressed.
+// Instead of materializing A, which for large M dominates the memory of both
+// parties, the streamed variants of Setup and Query regenerate it from the seed
+// streamRows rows at a time, so that A takes O(N) memory rather than O(M*N).
+//
+// DecompressState materializes the matrices from the same stream, so streamed
+// and materialized parties interoperate.
+
+// Number of rows of A regenerated at a time.
+const streamRows = uint64(256)
+
+// The expansion of a seed into the shared matrices, in the order Init samples
+// them. Each matrix must be consumed in full before the next one. The stream
+// is independent of the global PRG, which the seed must never reach.
+type seedStream struct {
+	stream *bufio.Reader
+	logq   uint64
+}
+
+func newSeedStream(comp CompressedState, p Params) *seedStream {
+	return &seedStream{
+		stream: bufio.NewReaderSize(NewPRGOfKind(comp.PRG, comp.Seed), bufSize),
+		logq:   p.Logq,
+	}
+}
+
+func (s *seedStream) read(buf []byte) {
+	if _, err := io.ReadFull(s.stream, buf); err != nil {
+		panic("Should never get here")
+	}
+}
+
+// Regenerates the next rows x cols matrix of the stream in full.
+func (s *seedStream) next(rows, cols uint64) *Matrix {
+	return matrixRandFrom(s.read, rows, cols, s.logq, 0)
+}
+
+// Regenerates the next rows x cols matrix of the stream, calling f on each
+// block of (at most streamRows) rows, along with the index of its first row.
+// Checks ctx for cancellation between blocks.
+func (s *seedStream) forEachBlock(ctx context.Context, rows, cols uint64, f func(offset uint64, block *Matrix)) error {
+	for off := uint64(0); off < rows; off += streamRows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := streamRows
+		if rows-off < n {
+			n = rows - off
+		}
+		f(off, matrixRandFrom(s.read, n, cols, s.logq, 0))
+	}
+	return nil
+}
+
+// Returns A * b, where A is the next rows x cols matrix of the stream.
+func (s *seedStream) mulRight(rows, cols uint64, b *Matrix) *Matrix {
+	out := MatrixNew(rows, b.Cols)
+	s.forEachBlock(context.Background(), rows, cols, func(off uint64, block *Matrix) {
+		copy(out.Data[off*b.Cols:], MatrixMul(block, b).Data)
+	})
+	return out
+}
+
+// Returns a * A, where A is the next rows x cols matrix of the stream, or
+// ctx's error if ctx is done first.
+func (s *seedStream) mulLeftCtx(ctx context.Context, a *Matrix, rows, cols uint64) (*Matrix, error) {
+	if a.Cols != rows {
+		logger.Error("dimension mismatch", "a_rows", a.Rows, "a_cols", a.Cols, "b_rows", rows, "b_cols", cols)
+		panic("Dimension mismatch")
+	}
+
+	out := MatrixZeros(a.Rows, cols)
+	err := s.forEachBlock(ctx, rows, cols, func(off uint64, block *Matrix) {
+		out.MatrixAdd(MatrixMul(a.ColsDeepCopy(off, block.Rows), block))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
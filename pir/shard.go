@@ -0,0 +1,410 @@
+package pir
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sharding of a SimplePIR database across workers, so that the DB need not
+// fit in the memory of one machine. Every shard uses the Params and shared
+// state of the whole DB.
+//
+// A ShardedServer splits the DB row-wise, which does not change the number of
+// LWE samples (the DB width): it fans each query out to the workers, which
+// multiply their rows by it, and concatenates their outputs into a normal
+// SimplePIR answer. A ColumnShardedServer splits the DB column-wise: each
+// worker receives only its slice of the query, and the coordinator sums the
+// workers' partial answers (and hints) mod 2^Logq.
+
+// A worker that holds a contiguous block of a DB: a slice of its rows or of
+// its columns. Workers in other processes implement this over an RPC
+// transport.
+type ShardWorker interface {
+	// Returns the number of DB rows and columns that the worker holds.
+	Rows() uint64
+	Cols() uint64
+
+	// Returns the worker's part of the hint DB * A (its block of the DB times
+	// the rows of A that match its columns), and the DBinfo of its block once
+	// set up, and prepares the block to answer queries. Setup must be safe to
+	// call again, after it failed or after another worker's setup failed.
+	Setup(ctx context.Context, shared State, p Params) (*Matrix, DBinfo, error)
+
+	// Returns rows [offset, offset+rows) of the worker's block, times the
+	// query vector q (the slice of the query that matches its columns).
+	Answer(ctx context.Context, offset, rows uint64, q *Matrix) (*Matrix, error)
+}
+
+// A ShardWorker that holds its block in memory, in this process.
+type LocalShard struct {
+	DB  *Database
+	Col uint64 // index of the first DB column in the block
+
+	hint *Matrix // the worker's part of the hint, once set up
+}
+
+func (s *LocalShard) Rows() uint64 {
+	return s.DB.Data.Rows
+}
+
+func (s *LocalShard) Cols() uint64 {
+	if s.DB.Info.Squishing > 0 {
+		return s.DB.Info.Cols // the width before squishing
+	}
+	return s.DB.Data.Cols
+}
+
+// Sets up the block on the first successful call; later calls return the same
+// hint without touching the block.
+func (s *LocalShard) Setup(ctx context.Context, shared State, p Params) (*Matrix, DBinfo, error) {
+	if s.hint != nil {
+		return s.hint.RowsDeepCopy(0, s.hint.Rows), s.DB.Info, nil
+	}
+
+	A := shared.Data[0]
+	if s.Cols() != A.Rows {
+		A = A.RowsDeepCopy(s.Col, s.Cols())
+	}
+	H, err := MatrixMulCtx(ctx, s.DB.Data, A)
+	if err != nil {
+		return nil, DBinfo{}, err
+	}
+
+	// as in SimplePIR's setup
+	s.DB.Data.Add(p.P / 2)
+	s.DB.Squish()
+
+	s.hint = H
+	return H.RowsDeepCopy(0, H.Rows), s.DB.Info, nil
+}
+
+func (s *LocalShard) Answer(ctx context.Context, offset, rows uint64, q *Matrix) (*Matrix, error) {
+	if offset+rows > s.DB.Data.Rows {
+		return nil, fmt.Errorf("%w: rows %d to %d of a shard of %d rows", ErrMalformedQuery,
+			offset, offset+rows, s.DB.Data.Rows)
+	}
+	if err := checkQueryVector(q, s.Cols(), s.DB.Info.Squishing, s.DB.Info.Logq); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedQuery, err)
+	}
+	return MatrixMulVecPackedCtx(ctx, s.DB.Data.SelectRows(offset, rows), q,
+		s.DB.Info.Basis, s.DB.Info.Squishing)
+}
+
+// Splits the rows of DB (which must not be set up yet) into num_shards
+// shards of about equal height, held by LocalShards.
+func ShardDB(DB *Database, num_shards uint64) []ShardWorker {
+	if num_shards == 0 || num_shards > DB.Data.Rows {
+		panic("Bad number of shards")
+	}
+
+	var workers []ShardWorker
+	last := uint64(0)
+	for j := uint64(0); j < num_shards; j++ {
+		rows := (DB.Data.Rows - last) / (num_shards - j)
+		shard := &Database{Info: DB.Info, Data: DB.Data.RowsDeepCopy(last, rows)}
+		workers = append(workers, &LocalShard{DB: shard})
+		last += rows
+	}
+	return workers
+}
+
+// Splits the columns of DB (which must not be set up yet) into num_shards
+// shards of about equal width, held by LocalShards.
+func ColumnShardDB(DB *Database, num_shards uint64) []ShardWorker {
+	if num_shards == 0 || num_shards > DB.Data.Cols {
+		panic("Bad number of shards")
+	}
+
+	var workers []ShardWorker
+	last := uint64(0)
+	for j := uint64(0); j < num_shards; j++ {
+		cols := (DB.Data.Cols - last) / (num_shards - j)
+		shard := &Database{Info: DB.Info, Data: DB.Data.ColsDeepCopy(last, cols)}
+		workers = append(workers, &LocalShard{DB: shard, Col: last})
+		last += cols
+	}
+	return workers
+}
+
+// Answers SimplePIR queries to a DB sharded row-wise across Workers, in the
+// order of the DB's rows.
+type ShardedServer struct {
+	Workers []ShardWorker
+	Info    DBinfo // of the whole DB, once set up
+}
+
+func NewShardedServer(workers []ShardWorker) *ShardedServer {
+	if len(workers) == 0 {
+		panic("Need at least one worker")
+	}
+	for _, w := range workers {
+		if w.Cols() != workers[0].Cols() {
+			panic("Shards have different widths")
+		}
+	}
+	return &ShardedServer{Workers: workers}
+}
+
+// Returns the number of rows of the whole DB.
+func (s *ShardedServer) Rows() uint64 {
+	rows := uint64(0)
+	for _, w := range s.Workers {
+		rows += w.Rows()
+	}
+	return rows
+}
+
+// Runs f(j) for each j in [0, n) concurrently, and returns the first error, if
+// any (after which the ctx that f receives is done).
+func fanOut(ctx context.Context, n int, f func(ctx context.Context, j int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	for j := 0; j < n; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			if err := f(ctx, j); err != nil {
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(j)
+	}
+	wg.Wait()
+	return first
+}
+
+// Sets up every shard, and returns the hint H = DB * A of the whole DB, as
+// SimplePIR's Setup does. If it fails, it can be retried.
+func (s *ShardedServer) Setup(ctx context.Context, shared State, p Params) (Msg, error) {
+	defer observeSince(MetricSetupSeconds, "SimplePIR", time.Now())
+
+	hints := make([]*Matrix, len(s.Workers))
+	infos := make([]DBinfo, len(s.Workers))
+	err := fanOut(ctx, len(s.Workers), func(ctx context.Context, j int) error {
+		var err error
+		hints[j], infos[j], err = s.Workers[j].Setup(ctx, shared, p)
+		return err
+	})
+	if err != nil {
+		return Msg{}, err
+	}
+
+	H := new(Matrix)
+	for _, h := range hints {
+		H.Concat(h)
+	}
+	s.Info = infos[0]
+	metrics.AddCounter(MetricSetups, 1, "scheme", "SimplePIR")
+	return MakeMsg(H), nil
+}
+
+// A slice of rows of one worker that answers part of one query.
+type shardJob struct {
+	worker       int
+	query        int
+	offset, rows uint64
+}
+
+// Answers a batch of SimplePIR queries, as SimplePIR's AnswerCtx does: each
+// query in the batch scans its own slice of the DB's rows, which may span
+// several workers.
+func (s *ShardedServer) Answer(ctx context.Context, query MsgSlice, p Params) (Msg, error) {
+	pi := &SimplePIR{}
+	total := s.Rows()
+	num_queries := uint64(len(query.Data))
+	if err := checkBatchSize(num_queries, total, s.Info); err != nil {
+		return Msg{}, err
+	}
+	for _, q := range query.Data {
+		if err := pi.CheckQuery(q, p, s.Info); err != nil {
+			return Msg{}, err
+		}
+	}
+
+	defer observeSince(MetricAnswerSeconds, pi.Name(), time.Now())
+	metrics.Observe(MetricAnswerBatchSize, float64(num_queries), "scheme", pi.Name())
+
+	// split each query's slice of rows at the workers' boundaries, in order
+	var jobs []shardJob
+	batch_sz := total / num_queries
+	last := uint64(0)
+	for batch := uint64(0); batch < num_queries; batch++ {
+		if batch == num_queries-1 {
+			batch_sz = total - last
+		}
+		start := uint64(0)
+		for j, w := range s.Workers {
+			end := start + w.Rows()
+			lo, hi := start, end
+			if last > lo {
+				lo = last
+			}
+			if last+batch_sz < hi {
+				hi = last + batch_sz
+			}
+			if lo < hi {
+				jobs = append(jobs, shardJob{worker: j, query: int(batch), offset: lo - start, rows: hi - lo})
+			}
+			start = end
+		}
+		last += batch_sz
+	}
+
+	parts := make([]*Matrix, len(jobs))
+	err := fanOut(ctx, len(jobs), func(ctx context.Context, j int) error {
+		job := jobs[j]
+		var err error
+		parts[j], err = s.Workers[job.worker].Answer(ctx, job.offset, job.rows,
+			query.Data[job.query].Data[0])
+		if err == nil && parts[j].Rows != job.rows {
+			err = fmt.Errorf("worker %d returned %d rows, want %d", job.worker, parts[j].Rows, job.rows)
+		}
+		return err
+	})
+	if err != nil {
+		return Msg{}, err
+	}
+
+	ans := new(Matrix)
+	for _, part := range parts {
+		ans.Concat(part)
+	}
+	metrics.AddCounter(MetricQueriesAnswered, float64(num_queries), "scheme", pi.Name())
+	return MakeMsg(switchAnswer(ans, p)), nil
+}
+
+// Answers SimplePIR queries to a DB sharded column-wise across Workers, in
+// the order of the DB's columns.
+type ColumnShardedServer struct {
+	Workers []ShardWorker
+	Info    DBinfo // of the whole DB, once set up
+}
+
+func NewColumnShardedServer(workers []ShardWorker) *ColumnShardedServer {
+	if len(workers) == 0 {
+		panic("Need at least one worker")
+	}
+	for _, w := range workers {
+		if w.Rows() != workers[0].Rows() {
+			panic("Shards have different heights")
+		}
+	}
+	return &ColumnShardedServer{Workers: workers}
+}
+
+// Returns the number of columns of the whole DB.
+func (s *ColumnShardedServer) Cols() uint64 {
+	cols := uint64(0)
+	for _, w := range s.Workers {
+		cols += w.Cols()
+	}
+	return cols
+}
+
+// Sets up every shard, and returns the hint H = DB * A of the whole DB, as
+// SimplePIR's Setup does: the sum of the workers' parts. If it fails, it can
+// be retried.
+func (s *ColumnShardedServer) Setup(ctx context.Context, shared State, p Params) (Msg, error) {
+	defer observeSince(MetricSetupSeconds, "SimplePIR", time.Now())
+
+	hints := make([]*Matrix, len(s.Workers))
+	infos := make([]DBinfo, len(s.Workers))
+	err := fanOut(ctx, len(s.Workers), func(ctx context.Context, j int) error {
+		var err error
+		hints[j], infos[j], err = s.Workers[j].Setup(ctx, shared, p)
+		return err
+	})
+	if err != nil {
+		return Msg{}, err
+	}
+
+	H := hints[0]
+	for _, h := range hints[1:] {
+		H.MatrixAdd(h)
+	}
+	s.Info = infos[0]
+	s.Info.Cols = s.Cols()
+	metrics.AddCounter(MetricSetups, 1, "scheme", "SimplePIR")
+	return MakeMsg(H), nil
+}
+
+// Returns rows [offset, offset+rows) of the query vector q, padded to match
+// the squished DB.
+func sliceQuery(q *Matrix, offset, rows, squishing uint64) *Matrix {
+	out := q.RowsDeepCopy(offset, rows)
+	if rows%squishing != 0 {
+		out.AppendZeros(squishing - rows%squishing)
+	}
+	return out
+}
+
+// Answers a batch of SimplePIR queries, as SimplePIR's AnswerCtx does: each
+// query in the batch scans its own slice of the DB's rows, in every worker.
+func (s *ColumnShardedServer) Answer(ctx context.Context, query MsgSlice, p Params) (Msg, error) {
+	pi := &SimplePIR{}
+	total := s.Workers[0].Rows()
+	num_queries := uint64(len(query.Data))
+	if err := checkBatchSize(num_queries, total, s.Info); err != nil {
+		return Msg{}, err
+	}
+	for _, q := range query.Data {
+		if err := pi.CheckQuery(q, p, s.Info); err != nil {
+			return Msg{}, err
+		}
+	}
+
+	defer observeSince(MetricAnswerSeconds, pi.Name(), time.Now())
+	metrics.Observe(MetricAnswerBatchSize, float64(num_queries), "scheme", pi.Name())
+
+	// every worker answers every query, with its slice of the query
+	var jobs []shardJob
+	var slices []*Matrix
+	batch_sz := total / num_queries
+	last := uint64(0)
+	for batch := uint64(0); batch < num_queries; batch++ {
+		if batch == num_queries-1 {
+			batch_sz = total - last
+		}
+		col := uint64(0)
+		for j, w := range s.Workers {
+			jobs = append(jobs, shardJob{worker: j, query: int(batch), offset: last, rows: batch_sz})
+			slices = append(slices, sliceQuery(query.Data[batch].Data[0], col, w.Cols(), s.Info.Squishing))
+			col += w.Cols()
+		}
+		last += batch_sz
+	}
+
+	parts := make([]*Matrix, len(jobs))
+	err := fanOut(ctx, len(jobs), func(ctx context.Context, j int) error {
+		job := jobs[j]
+		var err error
+		parts[j], err = s.Workers[job.worker].Answer(ctx, job.offset, job.rows, slices[j])
+		if err == nil && parts[j].Rows != job.rows {
+			err = fmt.Errorf("worker %d returned %d rows, want %d", job.worker, parts[j].Rows, job.rows)
+		}
+		return err
+	})
+	if err != nil {
+		return Msg{}, err
+	}
+
+	// sum the partial answers to each query mod 2^32 (and so mod 2^Logq)
+	ans := new(Matrix)
+	for j := 0; j < len(parts); j += len(s.Workers) {
+		sum := parts[j]
+		for _, part := range parts[j+1 : j+len(s.Workers)] {
+			sum.MatrixAdd(part)
+		}
+		ans.Concat(sum)
+	}
+	metrics.AddCounter(MetricQueriesAnswered, float64(num_queries), "scheme", pi.Name())
+	return MakeMsg(switchAnswer(ans, p)), nil
+}
@@ -3,7 +3,9 @@ package pir
 // #cgo CFLAGS: -O3 -march=native
 // #include "pir.h"
 import "C"
+import "context"
 import "fmt"
+import "time"
 
 type SimplePIR struct{}
 
@@ -12,35 +14,31 @@ func (pi *SimplePIR) Name() string {
 }
 
 func (pi *SimplePIR) PickParams(N, d, n, logq uint64) Params {
+	p := pi.pickParams(N, d, n, logq)
+	p.PrintParams()
+	return p
+}
+
+// Like PickParams, but does not print the params.
+func (pi *SimplePIR) pickParams(N, d, n, logq uint64) Params {
 	good_p := Params{}
 	found := false
 
 	// Iteratively refine p and DB dims, until find tight values
 	for mod_p := uint64(2); ; mod_p += 1 {
 		l, m := ApproxSquareDatabaseDims(N, d, mod_p)
-
-		p := Params{
-			N:    n,
-			Logq: logq,
-			L:    l,
-			M:    m,
-		}
-		p.PickParams(false, m)
+		p := pi.PickParamsGivenDimensions(l, m, n, logq)
 
 		if p.P < mod_p {
 			if !found {
 				panic("Error; should not happen")
 			}
-			good_p.PrintParams()
 			return good_p
 		}
 
 		good_p = p
 		found = true
 	}
-
-	panic("Cannot be reached")
-	return Params{}
 }
 
 func (pi *SimplePIR) PickParamsGivenDimensions(l, m, n, logq uint64) Params {
@@ -54,46 +52,71 @@ func (pi *SimplePIR) PickParamsGivenDimensions(l, m, n, logq uint64) Params {
         return p
 }
 
-// Works for SimplePIR because vertical concatenation doesn't increase
-// the number of LWE samples (so don't need to change LWE params)
-func (pi *SimplePIR) ConcatDBs(DBs []*Database, p *Params) *Database {
-        if len(DBs) == 0 {
-                panic("Should not happen")
-        }
-
-        if DBs[0].Info.Num != p.L * p.M {
-                panic("Not yet implemented")
-        }
+// Combines DBs (which must not be set up, and may differ in their numbers of
+// entries and entry sizes) into one DB, with params for it picked afresh from
+// p's secret dimension and ciphertext modulus. The TableMap locates the
+// entries of each of DBs in the combined DB. Returns ErrTableWidths if DBs
+// differ so much in entry width that the combined DB would be far larger than
+// they are.
+func (pi *SimplePIR) ConcatDBs(DBs []*Database, p Params) (*Database, Params, *TableMap, error) {
+	return concatDBs(DBs, p, pi.pickParams)
+}
 
-        rows := DBs[0].Data.Rows
-        for j:=1; j<len(DBs); j++ {
-                if DBs[j].Data.Rows != rows {
-                        panic("Bad input")
-                }
-        }
+// Picks the DB dimensions that minimize communication per query, when the
+// client makes num_queries queries for each hint download. For few queries,
+// this favors short, wide databases (small hint); for many queries, it
+// converges to ~square databases.
+func (pi *SimplePIR) PickParamsForQueries(N, d, n, logq, num_queries uint64) (Params, DBShape) {
+	if num_queries == 0 {
+		panic("Need at least one query")
+	}
 
-        D := new(Database)
-        D.Data = MatrixZeros(0, 0)
-        D.Info = DBs[0].Info
-        D.Info.Num *= uint64(len(DBs))
-        p.L *= uint64(len(DBs))
+	shape := func(m uint64) (Params, DBShape) {
+		p := Params{
+			N:    n,
+			Logq: logq,
+			M:    m,
+		}
+		p.PickParams(false, m)
+		p.L = DatabaseHeightGivenWidth(N, d, p.P, m)
 
-	for j:=0; j<len(DBs); j++ {
-		D.Data.Concat(DBs[j].Data.SelectRows(0, rows))
+		_, ne, _ := Num_DB_entries(N, d, p.P)
+		return p, DBShape{L: p.L, M: p.M, X: ne, Cost: pi.GetBW(DBinfo{Ne: ne, X: ne}, p)}
 	}
 
-        return D
+	m := searchDatabaseWidth(maxNumSamples(n, logq), func(m uint64) float64 {
+		_, s := shape(m)
+		return s.Cost.Amortized(num_queries)
+	})
+
+	p, s := shape(m)
+	p.PrintParams()
+	return p, s
 }
 
-func (pi *SimplePIR) GetBW(info DBinfo, p Params) {
-	offline_download := float64(p.L*p.N*p.Logq) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOffline download: %d KB\n", uint64(offline_download))
+func (pi *SimplePIR) GetBW(info DBinfo, p Params) CostReport {
+	return CostReport{
+		Scheme: pi.Name(),
+
+		Offline_download: kbytes(p.L*p.N, p.Logq),
+		Online_upload:    kbytes(p.M, p.Logq),
+		Online_download:  kbytes(p.L, p.answerLogq()),
+		Hint_size:        kbytes(p.L*p.N, p.Logq),
+
+		Setup_ops:  p.L * p.M * p.N,   // H = DB * A
+		Server_ops: p.L * p.M,         // DB * query
+		Client_ops: p.M*p.N + p.L*p.N, // A * secret, then H * secret
 
-	online_upload := float64(p.M*p.Logq) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOnline upload: %d KB\n", uint64(online_upload))
+		// the DB is squished to 3 Z_p elems per Elem; A is shared
+		Server_memory: kbytes(p.L*((p.M+2)/3)+p.M*p.N, 32),
+		Client_memory: kbytes(p.L*p.N+p.M*p.N, 32),
+	}
+}
 
-	online_download := float64(p.L*p.Logq) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOnline download: %d KB\n", uint64(online_download))
+// Sets p.Logq_answer to the smallest modulus that answers can be switched to
+// without noticeably raising the probability of decryption failures.
+func (pi *SimplePIR) PickAnswerModulus(p *Params, info DBinfo) {
+	p.Logq_answer = pickAnswerLogq(*p, noiseBound(*p, p.M))
 }
 
 func (pi *SimplePIR) Init(info DBinfo, p Params) State {
@@ -107,18 +130,39 @@ func (pi *SimplePIR) InitCompressed(info DBinfo, p Params) (State, CompressedSta
 }
 
 func (pi *SimplePIR) InitCompressedSeeded(info DBinfo, p Params, seed *PRGKey) (State, CompressedState) {
-        bufPrgReader = NewBufPRG(NewPRG(seed))
-        return pi.Init(info, p), MakeCompressedState(seed)
+	return pi.InitCompressedSeededPRG(info, p, seed, AESCTR)
 }
 
+// Like InitCompressedSeeded, but expands seed with the given kind of PRG.
+func (pi *SimplePIR) InitCompressedSeededPRG(info DBinfo, p Params, seed *PRGKey, kind PRGKind) (State, CompressedState) {
+	comp := MakeCompressedState(seed)
+	comp.PRG = kind
+	return pi.DecompressState(info, p, comp), comp
+}
+
+// Expands A from the seed with a PRG of its own, so that the (public) seed
+// does not determine the randomness that the caller samples afterwards.
 func (pi *SimplePIR) DecompressState(info DBinfo, p Params, comp CompressedState) State {
-	bufPrgReader = NewBufPRG(NewPRG(comp.Seed))
-	return pi.Init(info, p)
+	s := newSeedStream(comp, p)
+	return MakeState(s.next(p.M, p.N))
 }
 
 func (pi *SimplePIR) Setup(DB *Database, shared State, p Params) (State, Msg) {
+	server, hint, _ := pi.SetupCtx(context.Background(), DB, shared, p)
+	return server, hint
+}
+
+// Like Setup, but gives up (leaving DB unmodified) and returns ctx's error if
+// ctx is done before the hint is computed.
+func (pi *SimplePIR) SetupCtx(ctx context.Context, DB *Database, shared State, p Params) (State, Msg, error) {
+	defer observeSince(MetricSetupSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricSetups, 1, "scheme", pi.Name())
+
 	A := shared.Data[0]
-	H := MatrixMul(DB.Data, A)
+	H, err := MatrixMulCtx(ctx, DB.Data, A)
+	if err != nil {
+		return State{}, Msg{}, err
+	}
 
 	// map the database entries to [0, p] (rather than [-p/1, p/2]) and then
 	// pack the database more tightly in memory, because the online computation
@@ -126,30 +170,68 @@ func (pi *SimplePIR) Setup(DB *Database, shared State, p Params) (State, Msg) {
 	DB.Data.Add(p.P / 2)
 	DB.Squish()
 
-	return MakeState(), MakeMsg(H)
+	return MakeState(), MakeMsg(H), nil
+}
+
+// Like Setup, but regenerates A from comp's seed as it goes, rather than
+// reading it from a materialized shared state.
+func (pi *SimplePIR) SetupStreamed(DB *Database, comp CompressedState, p Params) (State, Msg) {
+	server, hint, _ := pi.SetupStreamedCtx(context.Background(), DB, comp, p)
+	return server, hint
 }
 
-func (pi *SimplePIR) FakeSetup(DB *Database, p Params) (State, float64) {
-	offline_download := float64(p.L*p.N*uint64(p.Logq)) / (8.0 * 1024.0)
-	fmt.Printf("\t\tOffline download: %d KB\n", uint64(offline_download))
+// Like SetupCtx, but regenerates A from comp's seed as it goes.
+func (pi *SimplePIR) SetupStreamedCtx(ctx context.Context, DB *Database, comp CompressedState,
+	p Params) (State, Msg, error) {
+	defer observeSince(MetricSetupSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricSetups, 1, "scheme", pi.Name())
+
+	H, err := newSeedStream(comp, p).mulLeftCtx(ctx, DB.Data, p.M, p.N)
+	if err != nil {
+		return State{}, Msg{}, err
+	}
 
+	DB.Data.Add(p.P / 2)
+	DB.Squish()
+
+	return MakeState(), MakeMsg(H), nil
+}
+
+func (pi *SimplePIR) FakeSetup(DB *Database, p Params) State {
 	// map the database entries to [0, p] (rather than [-p/1, p/2]) and then
 	// pack the database more tightly in memory, because the online computation
 	// is memory-bandwidth-bound
 	DB.Data.Add(p.P / 2)
 	DB.Squish()
 
-	return MakeState(), offline_download
+	return MakeState()
 }
 
 func (pi *SimplePIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg) {
 	A := shared.Data[0]
+	return pi.query(i, p, info, func(secret *Matrix) *Matrix {
+		return MatrixMul(A, secret)
+	})
+}
+
+// Like Query, but regenerates A from comp's seed as it goes, so that the
+// client never holds A in memory. Recover does not use the shared state.
+func (pi *SimplePIR) QueryStreamed(i uint64, comp CompressedState, p Params, info DBinfo) (State, Msg) {
+	return pi.query(i, p, info, func(secret *Matrix) *Matrix {
+		return newSeedStream(comp, p).mulRight(p.M, p.N, secret)
+	})
+}
+
+// Builds a query for index i, where mulA returns A * secret.
+func (pi *SimplePIR) query(i uint64, p Params, info DBinfo, mulA func(secret *Matrix) *Matrix) (State, Msg) {
+	defer observeSince(MetricQuerySeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricQueriesBuilt, 1, "scheme", pi.Name())
 
 	secret := MatrixRand(p.N, 1, p.Logq, 0)
 	err := MatrixGaussian(p.M, 1)
-	query := MatrixMul(A, secret)
+	query := mulA(secret)
 	query.MatrixAdd(err)
-	query.Data[i%p.M] += C.Elem(p.Delta())
+	query.Data[info.elemIndex(i)%p.M] += C.Elem(p.Delta())
 
 	// Pad the query to match the dimensions of the compressed DB
 	if p.M%info.Squishing != 0 {
@@ -159,11 +241,60 @@ func (pi *SimplePIR) Query(i uint64, shared State, p Params, info DBinfo) (State
 	return MakeState(secret), MakeMsg(query)
 }
 
+// Checks that query has the shape of a query built by Query.
+func (pi *SimplePIR) CheckQuery(query Msg, p Params, info DBinfo) error {
+	if len(query.Data) != 1 {
+		return fmt.Errorf("%w: got %d matrices, want 1", ErrMalformedQuery, len(query.Data))
+	}
+	if err := checkQueryVector(query.Data[0], p.M, info.Squishing, p.Logq); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedQuery, err)
+	}
+	return nil
+}
+
 func (pi *SimplePIR) Answer(DB *Database, query MsgSlice, server State, shared State, p Params) Msg {
-	ans := new(Matrix)
+	ans, err := pi.AnswerCtx(context.Background(), DB, query, server, shared, p)
+	if err != nil {
+		panic(err)
+	}
+	return ans
+}
+
+// Like Answer, but returns an error instead of panicking on malformed queries,
+// and gives up and returns ctx's error if ctx is done before the answer is
+// computed.
+func (pi *SimplePIR) AnswerCtx(ctx context.Context, DB *Database, query MsgSlice, server State, shared State,
+	p Params) (Msg, error) {
 	num_queries := uint64(len(query.Data)) // number of queries in the batch of queries
-	batch_sz := DB.Data.Rows / num_queries // how many rows of the database each query in the batch maps to
+	if err := checkBatchSize(num_queries, DB.Data.Rows, DB.Info); err != nil {
+		return Msg{}, err
+	}
+	for _, q := range query.Data {
+		if err := pi.CheckQuery(q, p, DB.Info); err != nil {
+			return Msg{}, err
+		}
+	}
 
+	defer observeSince(MetricAnswerSeconds, pi.Name(), time.Now())
+	metrics.Observe(MetricAnswerBatchSize, float64(num_queries), "scheme", pi.Name())
+
+	ans, err := answerSlices(ctx, DB, query)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	metrics.AddCounter(MetricBytesScanned, float64(matrixBytes(DB.Data)), "scheme", pi.Name())
+	metrics.AddCounter(MetricQueriesAnswered, float64(num_queries), "scheme", pi.Name())
+	return MakeMsg(switchAnswer(ans, p)), nil
+}
+
+// Multiplies the DB by the first vector of each (checked) query in the batch.
+// Each query in the batch scans its own slice of the DB, so the batch as a
+// whole scans the DB once.
+func answerSlices(ctx context.Context, DB *Database, query MsgSlice) (*Matrix, error) {
+	ans := new(Matrix)
+	num_queries := uint64(len(query.Data))
+	batch_sz := DB.Data.Rows / num_queries // how many rows of the database each query in the batch maps to
 	last := uint64(0)
 
 	// Run SimplePIR's answer routine for each query in the batch
@@ -171,22 +302,55 @@ func (pi *SimplePIR) Answer(DB *Database, query MsgSlice, server State, shared S
 		if batch == int(num_queries-1) {
 			batch_sz = DB.Data.Rows - last
 		}
-		a := MatrixMulVecPacked(DB.Data.SelectRows(last, batch_sz),
+		a, err := MatrixMulVecPackedCtx(ctx, DB.Data.SelectRows(last, batch_sz),
 			q.Data[0],
 			DB.Info.Basis,
 			DB.Info.Squishing)
+		if err != nil {
+			return nil, err
+		}
 		ans.Concat(a)
 		last += batch_sz
 	}
+	return ans, nil
+}
 
-	return MakeMsg(ans)
+// Checks that answer has the shape of an answer to a batch of num_queries
+// queries. Clients should call this before Recover.
+func (pi *SimplePIR) CheckAnswer(answer Msg, num_queries uint64, p Params, info DBinfo) error {
+	if len(answer.Data) != 1 {
+		return fmt.Errorf("%w: got %d matrices, want 1", ErrMalformedAnswer, len(answer.Data))
+	}
+	// each query in the batch is answered by its own slice of the DB rows
+	if err := checkAnswerVector(answer.Data[0], p.L, p); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedAnswer, err)
+	}
+	return nil
 }
 
 func (pi *SimplePIR) Recover(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
 	shared State, client State, p Params, info DBinfo) uint64 {
+	val, _ := pi.RecoverNoise(i, batch_index, offline, query, answer, shared, client, p, info)
+	return val
+}
+
+// Like Recover, but also reports the noise in each decoded Z_p elem, to detect
+// probable decryption failures.
+func (pi *SimplePIR) RecoverNoise(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) (uint64, *NoiseReport) {
+	defer observeSince(MetricRecoverSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricRecoveries, 1, "scheme", pi.Name())
+
 	secret := client.Data[0]
 	H := offline.Data[0]
-	ans := answer.Data[0]
+	return simpleDecode(pi.Name(), i, query, answer, MatrixMul(H, secret), p, info)
+}
+
+// Decodes DB entry i from the answer to a SimplePIR query, given the product
+// interm = H * secret of the hint and the query's secret.
+func simpleDecode(scheme string, i uint64, query Msg, answer Msg, interm *Matrix, p Params,
+	info DBinfo) (uint64, *NoiseReport) {
+	ans := unswitchAnswer(answer.Data[0], p.L, p)
 
 	ratio := p.P/2
 	offset := uint64(0);
@@ -196,21 +360,33 @@ func (pi *SimplePIR) Recover(i uint64, batch_index uint64, offline Msg, query Ms
 	offset %= (1 << p.Logq)
 	offset = (1 << p.Logq)-offset
 
-	row := i / p.M
-	interm := MatrixMul(H, secret)
+	row := info.elemIndex(i) / p.M
 	ans.MatrixSub(interm)
 
 	var vals []uint64
+	report := newNoiseReport(p)
 	// Recover each Z_p element that makes up the desired database entry
 	for j := row * info.Ne; j < (row+1)*info.Ne; j++ {
 		noised := uint64(ans.Data[j]) + offset
 		denoised := p.Round(noised)
 		vals = append(vals, denoised)
+		report.Noise = append(report.Noise, p.Noise(noised))
 		//fmt.Printf("Reconstructing row %d: %d\n", j, denoised)
 	}
 	ans.MatrixAdd(interm)
 
-	return ReconstructElem(vals, i, info)
+	if report.ProbableFailure() {
+		logger.Warn("probable decryption failure", "scheme", scheme, "index", i, "budget", report.Budget())
+	}
+
+	return ReconstructElem(vals, i, info), report
+}
+
+// Like Recover, for a query built by QueryStreamed.
+func (pi *SimplePIR) RecoverStreamed(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	client State, p Params, info DBinfo) uint64 {
+	val, _ := pi.RecoverNoise(i, batch_index, offline, query, answer, State{}, client, p, info)
+	return val
 }
 
 func (pi *SimplePIR) Reset(DB *Database, p Params) {
@@ -0,0 +1,87 @@
+package pir
+
+import "errors"
+import "fmt"
+import "sort"
+
+// Serving several DBs (tables) as one. Their entries are concatenated, in
+// order, into a DB whose entries are as wide as the widest table's, with
+// params picked afresh for its size and entry width. A TableMap maps the
+// entries of the tables to entries of the combined DB.
+//
+// As every entry is widened to the widest table's, the combined DB can be much
+// larger than the tables together: e.g., 2^14 1-bit entries with 300 40-bit
+// ones take 40 bits per entry, some 20 times the size of the tables. Tables
+// that would more than double in size (ErrTableWidths) are better served as
+// separate DBs.
+
+var ErrTableWidths = errors.New("pir: tables differ too much in entry width to concatenate")
+
+const maxConcatBlowup = 2
+
+type TableMap struct {
+	Offsets     []uint64 // index in the combined DB of the first entry of each table
+	Nums        []uint64 // number of entries of each table
+	Row_lengths []uint64 // number of bits per entry of each table
+}
+
+// Returns the index in the combined DB of entry i of the given table.
+func (m *TableMap) Index(table int, i uint64) uint64 {
+	if table < 0 || table >= len(m.Offsets) || i >= m.Nums[table] {
+		panic("Index out of range")
+	}
+	return m.Offsets[table] + i
+}
+
+// Returns the table that holds entry index of the combined DB, and the index
+// of the entry in that table.
+func (m *TableMap) Locate(index uint64) (int, uint64) {
+	table := sort.Search(len(m.Offsets), func(t int) bool {
+		return m.Offsets[t]+m.Nums[t] > index
+	})
+	if table == len(m.Offsets) {
+		panic("Index out of range")
+	}
+	return table, index - m.Offsets[table]
+}
+
+// Returns the DB that concatenates DBs (which must not be set up), the params
+// that pick picks for it with p's secret dimension and ciphertext modulus, and
+// the map from the entries of DBs to its entries. Returns ErrTableWidths if the
+// combined DB would take more than maxConcatBlowup times the bits of DBs.
+func concatDBs(DBs []*Database, p Params,
+	pick func(N, d, n, logq uint64) Params) (*Database, Params, *TableMap, error) {
+	if len(DBs) == 0 {
+		panic("No DBs to concatenate")
+	}
+
+	m := &TableMap{}
+	num, row_length, bits := uint64(0), uint64(0), uint64(0)
+	for _, DB := range DBs {
+		if DB.Info.Squishing != 0 {
+			panic("DB is already set up")
+		}
+		m.Offsets = append(m.Offsets, num)
+		m.Nums = append(m.Nums, DB.Info.Num)
+		m.Row_lengths = append(m.Row_lengths, DB.Info.Row_length)
+		num += DB.Info.Num
+		bits += DB.Info.Num * DB.Info.Row_length
+		if DB.Info.Row_length > row_length {
+			row_length = DB.Info.Row_length
+		}
+	}
+	if num*row_length > maxConcatBlowup*bits {
+		return nil, Params{}, nil, fmt.Errorf("%w: combined DB would take %d bits, for %d bits of tables",
+			ErrTableWidths, num*row_length, bits)
+	}
+
+	vals := make([]uint64, 0, num)
+	for _, DB := range DBs {
+		for i := uint64(0); i < DB.Info.Num; i++ {
+			vals = append(vals, DB.GetElem(i))
+		}
+	}
+
+	q := pick(num, row_length, p.N, p.Logq)
+	return MakeDB(num, row_length, &q, vals), q, m, nil
+}
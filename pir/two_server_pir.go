@@ -0,0 +1,270 @@
+package pir
+
+import "context"
+import "fmt"
+import "time"
+
+// Two-server XOR PIR, for deployments that can assume two non-colluding
+// servers holding the same Database. It offers information-theoretic privacy
+// against each server alone, with no offline phase (no hint, no shared state).
+//
+// To fetch column col of the DB, the client sends a uniformly random bit vector
+// r to server A and r XOR e_col to server B. Each server returns DB * (its
+// vector), and the difference of the two answers is column col (up to sign).
+// The Msg that Query returns holds the query to server A, then the query to
+// server B; Answer answers every vector in each query, so each server answers
+// the Msg with its own query (see SplitQuery), and the client passes the two
+// answers, joined with JoinAnswers, to Recover. Answering the Msg that Query
+// returns in full simulates both servers.
+//
+// The scheme reuses the record encoding (and the in-memory compression) of
+// SimplePIR, so it can serve a Database built for SimplePIR with p <= 2^10.
+
+type TwoServerPIR struct{}
+
+// Plaintext modulus: as there is no noise, this packs as many bits into each
+// Z_p elem as the DB compression allows.
+const twoServerP = uint64(1 << 10)
+
+func (pi *TwoServerPIR) Name() string {
+	return "TwoServerPIR"
+}
+
+// Picks a square DB; there is no LWE, so n is ignored.
+func (pi *TwoServerPIR) PickParams(N, d, n, logq uint64) Params {
+	l, m := ApproxSquareDatabaseDims(N, d, twoServerP)
+	p := pi.PickParamsGivenDimensions(l, m, n, logq)
+	p.PrintParams()
+	return p
+}
+
+func (pi *TwoServerPIR) PickParamsGivenDimensions(l, m, n, logq uint64) Params {
+	return Params{
+		Logq: logq,
+		L:    l,
+		M:    m,
+		P:    twoServerP,
+	}
+}
+
+func (pi *TwoServerPIR) GetBW(info DBinfo, p Params) CostReport {
+	return CostReport{
+		Scheme: pi.Name(),
+
+		// one bit per DB column, and one Z_q elem per DB row, per server
+		Online_upload:   kbytes(2*p.M, 1),
+		Online_download: kbytes(2*p.L, p.Logq),
+
+		Server_ops: p.L * p.M, // DB * query, at each server
+		Client_ops: p.M + p.L, // XOR in e_col, then subtract the answers
+
+		// the DB is squished to 3 Z_p elems per Elem, at each server
+		Server_memory: kbytes(p.L*((p.M+2)/3), 32),
+		Client_memory: kbytes(2*p.M+2*p.L, 32),
+	}
+}
+
+// There is no shared state.
+func (pi *TwoServerPIR) Init(info DBinfo, p Params) State {
+	return MakeState()
+}
+
+func (pi *TwoServerPIR) InitCompressed(info DBinfo, p Params) (State, CompressedState) {
+	return MakeState(), MakeCompressedState(RandomPRGKey())
+}
+
+func (pi *TwoServerPIR) DecompressState(info DBinfo, p Params, comp CompressedState) State {
+	return MakeState()
+}
+
+func (pi *TwoServerPIR) Setup(DB *Database, shared State, p Params) (State, Msg) {
+	server, hint, _ := pi.SetupCtx(context.Background(), DB, shared, p)
+	return server, hint
+}
+
+// There is no hint to compute, so this only compresses the DB (unless ctx is
+// already done).
+func (pi *TwoServerPIR) SetupCtx(ctx context.Context, DB *Database, shared State, p Params) (State, Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return State{}, Msg{}, err
+	}
+	metrics.AddCounter(MetricSetups, 1, "scheme", pi.Name())
+
+	DB.Data.Add(p.P / 2)
+	DB.Squish()
+
+	return MakeState(), MakeMsg(), nil
+}
+
+func (pi *TwoServerPIR) SetupStreamed(DB *Database, comp CompressedState, p Params) (State, Msg) {
+	return pi.Setup(DB, State{}, p)
+}
+
+func (pi *TwoServerPIR) FakeSetup(DB *Database, p Params) State {
+	server, _ := pi.Setup(DB, State{}, p)
+	return server
+}
+
+func (pi *TwoServerPIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg) {
+	defer observeSince(MetricQuerySeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricQueriesBuilt, 1, "scheme", pi.Name())
+
+	col := info.elemIndex(i) % p.M
+	queryA := MatrixRand(p.M, 1, 0, 2)
+	queryB := queryA.RowsDeepCopy(0, queryA.Rows)
+	queryB.Set(queryA.Get(col, 0)^1, col, 0)
+
+	// Pad the queries to match the dimensions of the compressed DB
+	if p.M%info.Squishing != 0 {
+		queryA.AppendZeros(info.Squishing - (p.M % info.Squishing))
+		queryB.AppendZeros(info.Squishing - (p.M % info.Squishing))
+	}
+
+	return MakeState(), MakeMsg(queryA, queryB)
+}
+
+func (pi *TwoServerPIR) QueryStreamed(i uint64, comp CompressedState, p Params, info DBinfo) (State, Msg) {
+	return pi.Query(i, State{}, p, info)
+}
+
+// Returns the part of query that goes to server A (0) or B (1).
+func (pi *TwoServerPIR) SplitQuery(query Msg, server int) Msg {
+	return MakeMsg(query.Data[server])
+}
+
+// Joins the answers of servers A and B, for Recover.
+func (pi *TwoServerPIR) JoinAnswers(answerA, answerB Msg) Msg {
+	return MakeMsg(answerA.Data[0], answerB.Data[0])
+}
+
+// Checks that query holds the query to one server, or to both, each a 0/1
+// vector of one elem per DB column.
+func (pi *TwoServerPIR) CheckQuery(query Msg, p Params, info DBinfo) error {
+	if len(query.Data) != 1 && len(query.Data) != 2 {
+		return fmt.Errorf("%w: got %d matrices, want 1 or 2", ErrMalformedQuery, len(query.Data))
+	}
+	for _, q := range query.Data {
+		if err := checkQueryVector(q, p.M, info.Squishing, 1); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedQuery, err)
+		}
+	}
+	return nil
+}
+
+func (pi *TwoServerPIR) Answer(DB *Database, query MsgSlice, server State, shared State, p Params) Msg {
+	ans, err := pi.AnswerCtx(context.Background(), DB, query, server, shared, p)
+	if err != nil {
+		panic(err)
+	}
+	return ans
+}
+
+// Like Answer, but returns an error instead of panicking on malformed queries,
+// and gives up and returns ctx's error if ctx is done before the answer is
+// computed.
+func (pi *TwoServerPIR) AnswerCtx(ctx context.Context, DB *Database, query MsgSlice, server State, shared State,
+	p Params) (Msg, error) {
+	num_queries := uint64(len(query.Data))
+	if err := checkBatchSize(num_queries, DB.Data.Rows, DB.Info); err != nil {
+		return Msg{}, err
+	}
+	for _, q := range query.Data {
+		if err := pi.CheckQuery(q, p, DB.Info); err != nil {
+			return Msg{}, err
+		}
+		if len(q.Data) != len(query.Data[0].Data) {
+			return Msg{}, fmt.Errorf("%w: queries in batch are for different servers", ErrMalformedQuery)
+		}
+	}
+	batch_sz := DB.Data.Rows / num_queries
+
+	defer observeSince(MetricAnswerSeconds, pi.Name(), time.Now())
+	metrics.Observe(MetricAnswerBatchSize, float64(num_queries), "scheme", pi.Name())
+
+	// as in SimplePIR, each query in the batch scans its own slice of the DB
+	msg := Msg{}
+	for s := range query.Data[0].Data {
+		ans := new(Matrix)
+		last := uint64(0)
+		sz := batch_sz
+		for batch, q := range query.Data {
+			if batch == int(num_queries-1) {
+				sz = DB.Data.Rows - last
+			}
+			a, err := MatrixMulVecPackedCtx(ctx, DB.Data.SelectRows(last, sz),
+				q.Data[s],
+				DB.Info.Basis,
+				DB.Info.Squishing)
+			if err != nil {
+				return Msg{}, err
+			}
+			ans.Concat(a)
+			last += sz
+		}
+		msg.Data = append(msg.Data, ans)
+	}
+
+	// the DB is scanned once per server's query
+	scanned := uint64(len(msg.Data)) * matrixBytes(DB.Data)
+	metrics.AddCounter(MetricBytesScanned, float64(scanned), "scheme", pi.Name())
+	metrics.AddCounter(MetricQueriesAnswered, float64(num_queries), "scheme", pi.Name())
+	return msg, nil
+}
+
+// Checks that answer holds the answers of both servers to a batch of
+// num_queries queries.
+func (pi *TwoServerPIR) CheckAnswer(answer Msg, num_queries uint64, p Params, info DBinfo) error {
+	if len(answer.Data) != 2 {
+		return fmt.Errorf("%w: got %d matrices, want 2", ErrMalformedAnswer, len(answer.Data))
+	}
+	for _, a := range answer.Data {
+		if err := checkMatrix(a, p.L, 1, p.Logq); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedAnswer, err)
+		}
+	}
+	return nil
+}
+
+func (pi *TwoServerPIR) Recover(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) uint64 {
+	val, _ := pi.RecoverNoise(i, batch_index, offline, query, answer, shared, client, p, info)
+	return val
+}
+
+// Like Recover; there is no noise, so the report holds zeros.
+func (pi *TwoServerPIR) RecoverNoise(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) (uint64, *NoiseReport) {
+	defer observeSince(MetricRecoverSeconds, pi.Name(), time.Now())
+	metrics.AddCounter(MetricRecoveries, 1, "scheme", pi.Name())
+
+	col := info.elemIndex(i) % p.M
+	row := info.elemIndex(i) / p.M
+
+	// the answer of the server whose query did not select col is subtracted
+	ansA, ansB := answer.Data[0], answer.Data[1]
+	if query.Data[0].Get(col, 0) == 1 {
+		ansA, ansB = ansB, ansA
+	}
+
+	var vals []uint64
+	report := newNoiseReport(p)
+	for j := row * info.Ne; j < (row+1)*info.Ne; j++ {
+		// undo the shift to [0, p] of Setup
+		v := (ansB.Get(j, 0) - ansA.Get(j, 0) - p.P/2) % (1 << p.Logq)
+		vals = append(vals, v)
+		report.Noise = append(report.Noise, 0)
+	}
+
+	return ReconstructElem(vals, i, info), report
+}
+
+func (pi *TwoServerPIR) RecoverStreamed(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg,
+	client State, p Params, info DBinfo) uint64 {
+	return pi.Recover(i, batch_index, offline, query, answer, State{}, client, p, info)
+}
+
+func (pi *TwoServerPIR) Reset(DB *Database, p Params) {
+	// Uncompress the database, and map its entries to the range [-p/2, p/2].
+	DB.Unsquish()
+	DB.Data.Sub(p.P / 2)
+}
@@ -1,7 +1,8 @@
 package pir
 
-import "math"
+import "errors"
 import "fmt"
+import "math"
 
 type State struct {
 	Data []*Matrix
@@ -9,6 +10,7 @@ type State struct {
 
 type CompressedState struct {
 	Seed *PRGKey
+	PRG  PRGKind // how Seed is expanded into the shared state
 }
 
 type Msg struct {
@@ -35,6 +37,91 @@ func (m *MsgSlice) Size() uint64 {
 	return sz
 }
 
+// Returned (wrapped) when a message does not have the shape that Params and
+// DBinfo dictate, so that neither side decodes or computes on it.
+var ErrMalformedQuery = errors.New("pir: malformed query")
+var ErrMalformedAnswer = errors.New("pir: malformed answer")
+
+// Checks that m is a rows-by-cols matrix over Z_q, where q = 2^logq.
+func checkMatrix(m *Matrix, rows, cols, logq uint64) error {
+	if m == nil {
+		return errors.New("missing matrix")
+	}
+	if m.Rows != rows || m.Cols != cols || uint64(len(m.Data)) != rows*cols {
+		return fmt.Errorf("got %d-by-%d matrix, want %d-by-%d", m.Rows, m.Cols, rows, cols)
+	}
+	if logq < 32 {
+		for _, v := range m.Data {
+			if uint64(v) >= (1 << logq) {
+				return fmt.Errorf("elem %d out of range", v)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that m is a query vector of rows elems over Z_q, zero-padded to a
+// multiple of squishing rows to match the compressed DB.
+func checkQueryVector(m *Matrix, rows, squishing, logq uint64) error {
+	if squishing == 0 {
+		return errors.New("DB is not set up")
+	}
+	padded := (rows + squishing - 1) / squishing * squishing
+	if err := checkMatrix(m, padded, 1, logq); err != nil {
+		return err
+	}
+	for j := rows; j < padded; j++ {
+		if m.Data[j] != 0 {
+			return errors.New("nonzero padding")
+		}
+	}
+	return nil
+}
+
+// Checks that a batch of num_queries queries can be answered by a DB with the
+// given number of rows.
+func checkBatchSize(num_queries uint64, rows uint64, info DBinfo) error {
+	if num_queries == 0 || rows/num_queries < info.Ne {
+		return fmt.Errorf("%w: cannot answer batch of %d queries", ErrMalformedQuery, num_queries)
+	}
+	return nil
+}
+
+// Like pi.Recover, but first checks that entry i lies in the slice of the DB
+// that query batch_index of a batch of num_queries scans, and that query and
+// answer have the shapes that pi builds and answers them in. Returns an error,
+// rather than panicking or decoding another entry, if not.
+func RecoverChecked(pi PIR, i uint64, batch_index uint64, num_queries uint64, offline Msg, query Msg,
+	answer Msg, shared State, client State, p Params, info DBinfo) (uint64, error) {
+	if err := checkBatchSize(num_queries, p.L, info); err != nil {
+		return 0, err
+	}
+	if i >= info.Num || batch_index >= num_queries {
+		return 0, fmt.Errorf("%w: entry %d of query %d of %d out of range", ErrMalformedQuery,
+			i, batch_index, num_queries)
+	}
+
+	// as in Answer, each query scans its own slice of the DB rows
+	batch_sz := p.L / num_queries
+	start, end := batch_index*batch_sz, (batch_index+1)*batch_sz
+	if batch_index == num_queries-1 {
+		end = p.L
+	}
+	row := info.elemIndex(i) / p.M * info.Ne
+	if row < start || row+info.Ne > end {
+		return 0, fmt.Errorf("%w: entry %d is not in the DB rows of query %d of %d", ErrMalformedQuery,
+			i, batch_index, num_queries)
+	}
+
+	if err := pi.CheckQuery(query, p, info); err != nil {
+		return 0, err
+	}
+	if err := pi.CheckAnswer(answer, num_queries, p, info); err != nil {
+		return 0, err
+	}
+	return pi.Recover(i, batch_index, offline, query, answer, shared, client, p, info), nil
+}
+
 func MakeState(elems ...*Matrix) State {
 	st := State{}
 	for _, elem := range elems {
@@ -99,7 +186,7 @@ func Num_DB_entries(N, row_length, p uint64) (uint64, uint64, uint64) {
 		entries_per_elem := logp / row_length
 		db_entries := uint64(math.Ceil(float64(N) / float64(entries_per_elem)))
 		if db_entries == 0 || db_entries > N {
-			fmt.Printf("Num entries is %d; N is %d\n", db_entries, N)
+			logger.Error("bad number of DB entries", "db_entries", db_entries, "N", N)
 			panic("Should not happen")
 		}
 		return db_entries, 1, entries_per_elem
@@ -0,0 +1,112 @@
+package pir
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Verifiable mode: every DB record carries, in its high-order bits, a MAC of
+// its index and value (truncated HMAC-SHA256) under a key that the data owner
+// shares with clients but not with the PIR server. If the server tampers with
+// its answer, the record that the client recovers fails the MAC check, except
+// with probability 2^-tag_bits. Since the MAC covers the index, the server also
+// cannot substitute another (validly tagged) record.
+//
+// This does not detect a server that answers honestly from a stale copy of a
+// database tagged under the same key; rotate the key when the DB changes.
+//
+// Whether the client accepts or rejects an answer is visible to the server if
+// the client acts on it (e.g., by retrying), so a server can tamper with the
+// answer in a way that only breaks some records and learn from the client's
+// reaction whether it queried one of them (a selective-failure attack). A
+// client that gets ErrBadMAC should thus stop querying that server, rather
+// than retry the query.
+
+type MACKey [32]byte
+
+// The server tampered with its answer; do not retry the query with it.
+var ErrBadMAC = errors.New("pir: recovered record fails MAC check")
+
+func RandomMACKey() *MACKey {
+	var key MACKey
+	_, err := io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return &key
+}
+
+func checkTagBits(row_length, tag_bits uint64) {
+	if tag_bits == 0 || row_length+tag_bits > 64 {
+		panic("Record and MAC must fit in 64 bits")
+	}
+}
+
+func lowBits(n uint64) uint64 {
+	if n == 64 {
+		return ^uint64(0)
+	}
+	return (1 << n) - 1
+}
+
+// Returns the tag_bits-bit MAC of the record val stored at index i.
+func recordTag(key *MACKey, i, val, tag_bits uint64) uint64 {
+	var msg [16]byte
+	binary.LittleEndian.PutUint64(msg[0:8], i)
+	binary.LittleEndian.PutUint64(msg[8:16], val)
+
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(msg[:])
+	return binary.LittleEndian.Uint64(mac.Sum(nil)) & lowBits(tag_bits)
+}
+
+// Returns the records in vals (of row_length bits each), each with its MAC
+// appended in the tag_bits bits above the record.
+func TagRecords(key *MACKey, vals []uint64, row_length, tag_bits uint64) []uint64 {
+	checkTagBits(row_length, tag_bits)
+
+	tagged := make([]uint64, len(vals))
+	for i, val := range vals {
+		if val > lowBits(row_length) {
+			panic("Record does not fit in row_length bits")
+		}
+		tagged[i] = val | (recordTag(key, uint64(i), val, tag_bits) << row_length)
+	}
+	return tagged
+}
+
+// Builds a database in which each of the Num records of row_length bits carries
+// a MAC of tag_bits bits. Params must be picked for entries of row_length+tag_bits
+// bits; clients pass recovered entries to VerifyRecord.
+func MakeVerifiableDB(Num, row_length, tag_bits uint64, p *Params, vals []uint64, key *MACKey) *Database {
+	return MakeDB(Num, row_length+tag_bits, p, TagRecords(key, vals, row_length, tag_bits))
+}
+
+// Checks the MAC on the entry recovered from index i of a verifiable database
+// and, if it is valid, returns the record without its MAC.
+func VerifyRecord(key *MACKey, i, entry, row_length, tag_bits uint64) (uint64, error) {
+	checkTagBits(row_length, tag_bits)
+
+	if entry > lowBits(row_length+tag_bits) {
+		return 0, ErrBadMAC
+	}
+	val := entry & lowBits(row_length)
+	tag := entry >> row_length
+
+	if !hmac.Equal(tagBytes(tag), tagBytes(recordTag(key, i, val, tag_bits))) {
+		return 0, ErrBadMAC
+	}
+	return val, nil
+}
+
+// Compare tags in constant time.
+func tagBytes(tag uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], tag)
+	return b[:]
+}
@@ -0,0 +1,113 @@
+package ring
+
+import (
+	"io"
+	"math/bits"
+)
+
+// Key switching of RLWE ciphertexts. A ciphertext (c0, c1) under secret s has
+// phase c0 + c1*s. Switching it to secret s' takes a key that encrypts s under
+// s', times each entry of the gadget vector; the switch decomposes c1 along
+// the gadget, into polynomials with small coefficients, and sums their
+// products with the key.
+//
+// The gadget is RNS-aware: its entry (i, k) is 2^(k*BaseBits) mod the i-th
+// prime and 0 mod the others, so the decomposition of c1 is the base-2^BaseBits
+// digits of its residues mod each prime. The error that a switch adds grows
+// with 2^BaseBits, and the size of the key with 1/BaseBits.
+
+type KeySwitchKey struct {
+	BaseBits uint64
+
+	// entry (i, k) of the gadget at index i*digits + k, in the NTT domain
+	A []*Poly
+	B []*Poly
+}
+
+// Returns the number of base-2^baseBits digits of the residues mod q.
+func numDigits(q, baseBits uint64) uint64 {
+	return (uint64(bits.Len64(q)) + baseBits - 1) / baseBits
+}
+
+// Returns a key that switches ciphertexts from secret from to secret to (both
+// in coefficient form), with errors of binomial parameter eta.
+func (r *Ring) GenKeySwitchKey(from, to *Poly, baseBits uint64, eta uint64, rand io.Reader) *KeySwitchKey {
+	if baseBits == 0 || baseBits > 32 {
+		panic("Bad decomposition base")
+	}
+
+	from_ntt, to_ntt := from.Copy(), to.Copy()
+	r.NTT(from_ntt)
+	r.NTT(to_ntt)
+
+	key := &KeySwitchKey{BaseBits: baseBits}
+	for i, q := range r.Moduli {
+		for k := uint64(0); k < numDigits(q, baseBits); k++ {
+			a := r.UniformPoly(rand)
+			r.NTT(a)
+			b := r.CBDPoly(rand, eta)
+			r.NTT(b)
+
+			// b = -a*to + e + g_(i,k)*from
+			tmp := r.NewPoly()
+			r.MulCoeffs(a, to_ntt, tmp)
+			r.Sub(b, tmp, b)
+			g := powMod(2, k*baseBits, q)
+			gs := shoup(g, q)
+			for j, v := range from_ntt.Coeffs[i] {
+				b.Coeffs[i][j] = reduceOnce(b.Coeffs[i][j]+mulShoup(v, g, gs, q), q)
+			}
+
+			key.A = append(key.A, a)
+			key.B = append(key.B, b)
+		}
+	}
+	return key
+}
+
+// Returns (d0, d1), in the NTT domain, such that d0 + d1*to is close to c*from,
+// for c in coefficient form and key a key from from to to.
+func (r *Ring) KeySwitch(c *Poly, key *KeySwitchKey) (*Poly, *Poly) {
+	d0, d1 := r.NewPoly(), r.NewPoly()
+	digit := r.NewPoly()
+	mask := uint64(1)<<key.BaseBits - 1
+
+	idx := 0
+	for i, q := range r.Moduli {
+		for k := uint64(0); k < numDigits(q, key.BaseBits); k++ {
+			for j, v := range c.Coeffs[i] {
+				d := (v >> (k * key.BaseBits)) & mask
+				for l := range r.Moduli {
+					digit.Coeffs[l][j] = d
+				}
+			}
+			r.NTT(digit)
+			r.MulCoeffsAdd(digit, key.B[idx], d0)
+			r.MulCoeffsAdd(digit, key.A[idx], d1)
+			idx += 1
+		}
+	}
+	return d0, d1
+}
+
+// Returns a key for ApplyGalois with the automorphism X -> X^k, for secret s
+// (in coefficient form).
+func (r *Ring) GenGaloisKey(s *Poly, k uint64, baseBits uint64, eta uint64, rand io.Reader) *KeySwitchKey {
+	sk := r.NewPoly()
+	r.Automorphism(s, k, sk)
+	return r.GenKeySwitchKey(sk, s, baseBits, eta, rand)
+}
+
+// Returns an encryption under s of m(X^k), given an encryption (c0, c1) of m
+// under s, in coefficient form, and the key from GenGaloisKey(s, k).
+func (r *Ring) ApplyGalois(c0, c1 *Poly, k uint64, key *KeySwitchKey) (*Poly, *Poly) {
+	a0, a1 := r.NewPoly(), r.NewPoly()
+	r.Automorphism(c0, k, a0)
+	r.Automorphism(c1, k, a1)
+
+	d0, d1 := r.KeySwitch(a1, key)
+	r.INTT(d0)
+	r.INTT(d1)
+	r.Add(d0, a0, d0)
+	return d0, d1
+}
@@ -0,0 +1,54 @@
+package ring
+
+import "math/big"
+
+// Modulus switching: scaling polynomials from Q down to a smaller modulus,
+// with rounding, which scales the error of a ciphertext along with it.
+
+// Returns round(p / q_L) mod Q / q_L, for q_L the last modulus of r and p in
+// coefficient form, as a polynomial of r.AtLevel(len(r.Moduli) - 2).
+func (r *Ring) DivRoundByLastModulus(p *Poly) *Poly {
+	L := len(r.Moduli) - 1
+	if L == 0 {
+		panic("Cannot drop the only modulus")
+	}
+	qL := r.Moduli[L]
+	half := qL / 2
+
+	// floor((x + q_L/2) / q_L) = (x + q_L/2 - [x + q_L/2]_{q_L}) / q_L
+	last := make([]uint64, r.N)
+	for j, v := range p.Coeffs[L] {
+		last[j] = (v + half) % qL
+	}
+
+	out := r.AtLevel(L - 1).NewPoly()
+	for i, q := range r.Moduli[:L] {
+		inv := invMod(qL%q, q)
+		invs := shoup(inv, q)
+		h := half % q
+		x, z := p.Coeffs[i], out.Coeffs[i]
+		for j := range z {
+			v := (x[j] + h) % q
+			v = (v + q - last[j]%q) % q
+			z[j] = mulShoup(v, inv, invs, q)
+		}
+	}
+	return out
+}
+
+// Returns round(t * x / Q) mod t for each coefficient x of p (in coefficient
+// form), for an arbitrary modulus t (e.g., a power of two) below 2^63.
+func (r *Ring) ScaleTo(p *Poly, t uint64) []uint64 {
+	Q := r.Modulus()
+	half := new(big.Int).Rsh(Q, 1)
+	bt := new(big.Int).SetUint64(t)
+
+	out := make([]uint64, r.N)
+	x := new(big.Int)
+	for j := uint64(0); j < r.N; j++ {
+		x.Set(r.CRT(p, j))
+		x.Mul(x, bt).Add(x, half).Quo(x, Q).Mod(x, bt)
+		out[j] = x.Uint64()
+	}
+	return out
+}
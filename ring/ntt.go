@@ -0,0 +1,140 @@
+package ring
+
+import "math/bits"
+
+// Arithmetic mod a single prime q < 2^62, and the negacyclic NTT mod q.
+
+// Returns a * b mod q, for a, b < q.
+func mulMod(a, b, q uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	_, r := bits.Div64(hi, lo, q)
+	return r
+}
+
+func powMod(a, e, q uint64) uint64 {
+	r := uint64(1)
+	a %= q
+	for ; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			r = mulMod(r, a, q)
+		}
+		a = mulMod(a, a, q)
+	}
+	return r
+}
+
+// Returns the inverse of a mod the prime q.
+func invMod(a, q uint64) uint64 {
+	return powMod(a, q-2, q)
+}
+
+// Returns floor(w * 2^64 / q), for multiplications by the constant w < q.
+func shoup(w, q uint64) uint64 {
+	quo, _ := bits.Div64(w, 0, q)
+	return quo
+}
+
+// Returns x mod q, for x < 2q (without branching, as x >= q is unpredictable).
+func reduceOnce(x, q uint64) uint64 {
+	x -= q
+	return x + (q & uint64(int64(x)>>63))
+}
+
+// Returns a * w mod q, given ws = shoup(w, q).
+func mulShoup(a, w, ws, q uint64) uint64 {
+	hi, _ := bits.Mul64(a, ws)
+	return reduceOnce(a*w-hi*q, q)
+}
+
+// Precomputed powers of a primitive 2n-th root of unity psi mod q (and of its
+// inverse), in bit-reversed order, for the negacyclic NTT.
+type nttTable struct {
+	q           uint64
+	nInv        uint64
+	nInvShoup   uint64
+	psi         []uint64
+	psiShoup    []uint64
+	psiInv      []uint64
+	psiInvShoup []uint64
+}
+
+func newNTTTable(q, logN uint64) *nttTable {
+	n := uint64(1) << logN
+	if (q-1)%(2*n) != 0 {
+		panic("Modulus is not NTT-friendly")
+	}
+
+	// psi has order exactly 2n iff psi^n = -1
+	var psi uint64
+	for g := uint64(2); ; g++ {
+		psi = powMod(g, (q-1)/(2*n), q)
+		if powMod(psi, n, q) == q-1 {
+			break
+		}
+	}
+	psiInv := invMod(psi, q)
+
+	t := &nttTable{
+		q:           q,
+		nInv:        invMod(n, q),
+		psi:         make([]uint64, n),
+		psiShoup:    make([]uint64, n),
+		psiInv:      make([]uint64, n),
+		psiInvShoup: make([]uint64, n),
+	}
+	t.nInvShoup = shoup(t.nInv, q)
+	for i := uint64(0); i < n; i++ {
+		rev := bits.Reverse64(i) >> (64 - logN)
+		t.psi[i] = powMod(psi, rev, q)
+		t.psiShoup[i] = shoup(t.psi[i], q)
+		t.psiInv[i] = powMod(psiInv, rev, q)
+		t.psiInvShoup[i] = shoup(t.psiInv[i], q)
+	}
+	return t
+}
+
+// Forward negacyclic NTT of a (in place, Cooley-Tukey); the output is in
+// bit-reversed order.
+func (t *nttTable) forward(a []uint64) {
+	q := t.q
+	n := uint64(len(a))
+	step := n
+	for m := uint64(1); m < n; m <<= 1 {
+		step >>= 1
+		for i := uint64(0); i < m; i++ {
+			w, ws := t.psi[m+i], t.psiShoup[m+i]
+			lo := a[2*i*step : (2*i+1)*step]
+			hi := a[(2*i+1)*step : (2*i+2)*step]
+			for j := range lo {
+				u := lo[j]
+				v := mulShoup(hi[j], w, ws, q)
+				lo[j] = reduceOnce(u+v, q)
+				hi[j] = reduceOnce(u+q-v, q)
+			}
+		}
+	}
+}
+
+// Inverse of forward (in place, Gentleman-Sande).
+func (t *nttTable) inverse(a []uint64) {
+	q := t.q
+	n := uint64(len(a))
+	step := uint64(1)
+	for m := n; m > 1; m >>= 1 {
+		h := m >> 1
+		for i := uint64(0); i < h; i++ {
+			w, ws := t.psiInv[h+i], t.psiInvShoup[h+i]
+			lo := a[2*i*step : (2*i+1)*step]
+			hi := a[(2*i+1)*step : (2*i+2)*step]
+			for j := range lo {
+				u, v := lo[j], hi[j]
+				lo[j] = reduceOnce(u+v, q)
+				hi[j] = mulShoup(u+q-v, w, ws, q)
+			}
+		}
+		step <<= 1
+	}
+	for j := range a {
+		a[j] = mulShoup(a[j], t.nInv, t.nInvShoup, q)
+	}
+}
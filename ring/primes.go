@@ -0,0 +1,35 @@
+package ring
+
+import "math/big"
+
+// Largest modulus bit length that the ring supports, so that sums of two
+// residues do not overflow.
+const MaxModulusBits = 61
+
+// Returns count distinct primes below 2^logq that are 1 mod 2^(logN+1), so
+// that the negacyclic NTT of degree 2^logN exists mod each of them, in
+// decreasing order.
+func GenerateNTTPrimes(logq, logN uint64, count int) []uint64 {
+	if logq > MaxModulusBits || logq <= logN+1 {
+		panic("Bad modulus size")
+	}
+
+	step := uint64(1) << (logN + 1)
+	var primes []uint64
+	for q := (uint64(1)<<logq-1)/step*step + 1; len(primes) < count; q -= step {
+		if q < step {
+			panic("Not enough NTT-friendly primes")
+		}
+		if new(big.Int).SetUint64(q).ProbablyPrime(20) {
+			primes = append(primes, q)
+		}
+	}
+	return primes
+}
+
+// Checks that q is a prime supported as an RNS modulus of a ring of degree
+// 2^logN.
+func isNTTPrime(q, logN uint64) bool {
+	return q < 1<<MaxModulusBits && q%(uint64(1)<<(logN+1)) == 1 &&
+		new(big.Int).SetUint64(q).ProbablyPrime(20)
+}
@@ -0,0 +1,235 @@
+// Package ring implements arithmetic in the polynomial ring
+// R_Q = Z_Q[X]/(X^N + 1), for N a power of two and Q a product of
+// NTT-friendly primes, for the ring-LWE layers of the PIR schemes.
+//
+// Polynomials are kept in RNS form: as their residues mod each prime of Q,
+// either as coefficients or in the NTT domain, where products in R_Q are
+// pointwise. The package does not track which form a polynomial is in; each
+// function documents the form it expects.
+package ring
+
+import "math/big"
+
+type Ring struct {
+	N      uint64
+	LogN   uint64
+	Moduli []uint64
+
+	tables []*nttTable
+}
+
+// A polynomial of a Ring, as its residues mod each prime of the Ring (with
+// Coeffs[i][j] the residue of coefficient, or NTT slot, j mod prime i).
+type Poly struct {
+	Coeffs [][]uint64
+}
+
+// Returns the ring of degree 2^logN mod the product of moduli, which must be
+// distinct primes that are 1 mod 2^(logN+1).
+func NewRing(logN uint64, moduli []uint64) *Ring {
+	if logN == 0 || logN > 17 || len(moduli) == 0 {
+		panic("Bad ring parameters")
+	}
+	r := &Ring{
+		N:      uint64(1) << logN,
+		LogN:   logN,
+		Moduli: append([]uint64(nil), moduli...),
+	}
+	for i, q := range moduli {
+		if !isNTTPrime(q, logN) {
+			panic("Modulus is not an NTT-friendly prime")
+		}
+		for _, prev := range moduli[:i] {
+			if prev == q {
+				panic("Moduli are not distinct")
+			}
+		}
+		r.tables = append(r.tables, newNTTTable(q, logN))
+	}
+	return r
+}
+
+// Returns the ring mod the first level+1 moduli of r, which shares r's NTT
+// tables. Polynomials of r map to it by dropping their last residues.
+func (r *Ring) AtLevel(level int) *Ring {
+	if level < 0 || level >= len(r.Moduli) {
+		panic("Bad level")
+	}
+	return &Ring{
+		N:      r.N,
+		LogN:   r.LogN,
+		Moduli: r.Moduli[:level+1],
+		tables: r.tables[:level+1],
+	}
+}
+
+// Returns Q, the product of the moduli.
+func (r *Ring) Modulus() *big.Int {
+	Q := big.NewInt(1)
+	for _, q := range r.Moduli {
+		Q.Mul(Q, new(big.Int).SetUint64(q))
+	}
+	return Q
+}
+
+func (r *Ring) NewPoly() *Poly {
+	p := &Poly{Coeffs: make([][]uint64, len(r.Moduli))}
+	for i := range p.Coeffs {
+		p.Coeffs[i] = make([]uint64, r.N)
+	}
+	return p
+}
+
+func (p *Poly) Copy() *Poly {
+	out := &Poly{Coeffs: make([][]uint64, len(p.Coeffs))}
+	for i := range p.Coeffs {
+		out.Coeffs[i] = append([]uint64(nil), p.Coeffs[i]...)
+	}
+	return out
+}
+
+func (p *Poly) Equal(other *Poly) bool {
+	if len(p.Coeffs) != len(other.Coeffs) {
+		return false
+	}
+	for i := range p.Coeffs {
+		if len(p.Coeffs[i]) != len(other.Coeffs[i]) {
+			return false
+		}
+		for j := range p.Coeffs[i] {
+			if p.Coeffs[i][j] != other.Coeffs[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Sets coefficient (or NTT slot) j of p to v.
+func (r *Ring) SetCoeff(p *Poly, j uint64, v int64) {
+	for i, q := range r.Moduli {
+		res := v % int64(q)
+		if res < 0 {
+			res += int64(q)
+		}
+		p.Coeffs[i][j] = uint64(res)
+	}
+}
+
+// Maps p from coefficients to the NTT domain, in place.
+func (r *Ring) NTT(p *Poly) {
+	for i, t := range r.tables {
+		t.forward(p.Coeffs[i])
+	}
+}
+
+// Maps p from the NTT domain to coefficients, in place.
+func (r *Ring) INTT(p *Poly) {
+	for i, t := range r.tables {
+		t.inverse(p.Coeffs[i])
+	}
+}
+
+// Sets out to a + b. out may alias the inputs, here and in the functions below
+// unless noted otherwise.
+func (r *Ring) Add(a, b, out *Poly) {
+	for i, q := range r.Moduli {
+		x, y, z := a.Coeffs[i], b.Coeffs[i], out.Coeffs[i]
+		for j := range z {
+			z[j] = reduceOnce(x[j]+y[j], q)
+		}
+	}
+}
+
+// Sets out to a - b.
+func (r *Ring) Sub(a, b, out *Poly) {
+	for i, q := range r.Moduli {
+		x, y, z := a.Coeffs[i], b.Coeffs[i], out.Coeffs[i]
+		for j := range z {
+			z[j] = reduceOnce(x[j]+q-y[j], q)
+		}
+	}
+}
+
+// Sets out to -a.
+func (r *Ring) Neg(a, out *Poly) {
+	for i, q := range r.Moduli {
+		x, z := a.Coeffs[i], out.Coeffs[i]
+		for j := range z {
+			if x[j] == 0 {
+				z[j] = 0
+			} else {
+				z[j] = q - x[j]
+			}
+		}
+	}
+}
+
+// Sets out to the pointwise product of a and b: their product in R_Q if both
+// are in the NTT domain.
+func (r *Ring) MulCoeffs(a, b, out *Poly) {
+	for i, q := range r.Moduli {
+		x, y, z := a.Coeffs[i], b.Coeffs[i], out.Coeffs[i]
+		for j := range z {
+			z[j] = mulMod(x[j], y[j], q)
+		}
+	}
+}
+
+// Sets out to out + the pointwise product of a and b.
+func (r *Ring) MulCoeffsAdd(a, b, out *Poly) {
+	for i, q := range r.Moduli {
+		x, y, z := a.Coeffs[i], b.Coeffs[i], out.Coeffs[i]
+		for j := range z {
+			z[j] = reduceOnce(z[j]+mulMod(x[j], y[j], q), q)
+		}
+	}
+}
+
+// Sets out to c * a, for an integer c (in either domain).
+func (r *Ring) MulScalar(a *Poly, c uint64, out *Poly) {
+	for i, q := range r.Moduli {
+		w := c % q
+		ws := shoup(w, q)
+		x, z := a.Coeffs[i], out.Coeffs[i]
+		for j := range z {
+			z[j] = mulShoup(x[j], w, ws, q)
+		}
+	}
+}
+
+// Sets out to a(X^k), for an odd k, in coefficient form. out must not alias a.
+func (r *Ring) Automorphism(a *Poly, k uint64, out *Poly) {
+	if k%2 == 0 {
+		panic("Automorphism index must be odd")
+	}
+	mask := 2*r.N - 1
+	for i, q := range r.Moduli {
+		x, z := a.Coeffs[i], out.Coeffs[i]
+		for j := uint64(0); j < r.N; j++ {
+			e := (j * k) & mask
+			if e < r.N {
+				z[e] = x[j]
+			} else if x[j] == 0 {
+				z[e-r.N] = 0
+			} else {
+				z[e-r.N] = q - x[j]
+			}
+		}
+	}
+}
+
+// Returns coefficient j of p (in coefficient form), in [0, Q), by CRT.
+func (r *Ring) CRT(p *Poly, j uint64) *big.Int {
+	Q := r.Modulus()
+	x := new(big.Int)
+	for i, q := range r.Moduli {
+		bq := new(big.Int).SetUint64(q)
+		Qi := new(big.Int).Quo(Q, bq)
+		inv := new(big.Int).ModInverse(new(big.Int).Mod(Qi, bq), bq)
+		term := new(big.Int).SetUint64(p.Coeffs[i][j])
+		term.Mul(term, inv).Mod(term, bq).Mul(term, Qi)
+		x.Add(x, term)
+	}
+	return x.Mod(x, Q)
+}
@@ -0,0 +1,277 @@
+package ring
+
+import (
+	"crypto/rand"
+	"math/big"
+	mrand "math/rand"
+	"testing"
+)
+
+const testLogN = 12
+const testEta = 21
+
+func testRing(logN uint64, num_moduli int) *Ring {
+	return NewRing(logN, GenerateNTTPrimes(50, logN, num_moduli))
+}
+
+// Returns Delta * m, for Delta = floor(Q / t).
+func encode(r *Ring, m []uint64, t uint64) *Poly {
+	delta := new(big.Int).Quo(r.Modulus(), new(big.Int).SetUint64(t))
+	p := r.NewPoly()
+	for i, q := range r.Moduli {
+		d := new(big.Int).Mod(delta, new(big.Int).SetUint64(q)).Uint64()
+		for j, v := range m {
+			p.Coeffs[i][j] = mulMod(d, v%q, q)
+		}
+	}
+	return p
+}
+
+// Returns an encryption (c0, c1) of Delta * m under s, in coefficient form.
+func encrypt(r *Ring, s *Poly, m []uint64, t uint64) (*Poly, *Poly) {
+	c1 := r.UniformPoly(rand.Reader)
+	c0 := r.NewPoly()
+	s_ntt := s.Copy()
+	r.NTT(s_ntt)
+	r.NTT(c1)
+	r.MulCoeffs(c1, s_ntt, c0)
+	r.INTT(c0)
+	r.INTT(c1)
+	r.Neg(c0, c0)
+	r.Add(c0, r.CBDPoly(rand.Reader, testEta), c0)
+	r.Add(c0, encode(r, m, t), c0)
+	return c0, c1
+}
+
+func decrypt(r *Ring, s *Poly, c0, c1 *Poly, t uint64) []uint64 {
+	s_ntt, phase := s.Copy(), c1.Copy()
+	r.NTT(s_ntt)
+	r.NTT(phase)
+	r.MulCoeffs(phase, s_ntt, phase)
+	r.INTT(phase)
+	r.Add(phase, c0, phase)
+	return r.ScaleTo(phase, t)
+}
+
+func randomMessage(r *Ring, t uint64) []uint64 {
+	m := make([]uint64, r.N)
+	for j := range m {
+		m[j] = mrand.Uint64() % t
+	}
+	return m
+}
+
+func TestGenerateNTTPrimes(t *testing.T) {
+	primes := GenerateNTTPrimes(40, testLogN, 4)
+	for i, q := range primes {
+		if !isNTTPrime(q, testLogN) || q >= 1<<40 {
+			panic("Failure")
+		}
+		if i > 0 && q >= primes[i-1] {
+			panic("Failure")
+		}
+	}
+}
+
+// Test that NTT-domain products are products in Z_Q[X]/(X^N + 1).
+func TestNegacyclicMul(t *testing.T) {
+	r := testRing(6, 2)
+	a := r.UniformPoly(rand.Reader)
+	b := r.UniformPoly(rand.Reader)
+
+	want := r.NewPoly()
+	for i, q := range r.Moduli {
+		for x := uint64(0); x < r.N; x++ {
+			for y := uint64(0); y < r.N; y++ {
+				prod := mulMod(a.Coeffs[i][x], b.Coeffs[i][y], q)
+				if x+y < r.N {
+					want.Coeffs[i][x+y] = (want.Coeffs[i][x+y] + prod) % q
+				} else {
+					want.Coeffs[i][x+y-r.N] = (want.Coeffs[i][x+y-r.N] + q - prod) % q
+				}
+			}
+		}
+	}
+
+	r.NTT(a)
+	r.NTT(b)
+	r.MulCoeffs(a, b, a)
+	r.INTT(a)
+	if !a.Equal(want) {
+		panic("Failure")
+	}
+}
+
+func TestNTTInverse(t *testing.T) {
+	r := testRing(testLogN, 3)
+	a := r.UniformPoly(rand.Reader)
+	b := a.Copy()
+	r.NTT(b)
+	if b.Equal(a) {
+		panic("Failure")
+	}
+	r.INTT(b)
+	if !b.Equal(a) {
+		panic("Failure")
+	}
+}
+
+// Test that automorphisms are ring homomorphisms, and that X -> X^k is undone
+// by X -> X^(k^-1 mod 2N).
+func TestAutomorphism(t *testing.T) {
+	r := testRing(testLogN, 2)
+	a := r.UniformPoly(rand.Reader)
+	b := r.UniformPoly(rand.Reader)
+	k := uint64(5)
+
+	ab := a.Copy()
+	b_ntt := b.Copy()
+	r.NTT(ab)
+	r.NTT(b_ntt)
+	r.MulCoeffs(ab, b_ntt, ab)
+	r.INTT(ab)
+	want := r.NewPoly()
+	r.Automorphism(ab, k, want)
+
+	ak, bk := r.NewPoly(), r.NewPoly()
+	r.Automorphism(a, k, ak)
+	r.Automorphism(b, k, bk)
+	r.NTT(ak)
+	r.NTT(bk)
+	r.MulCoeffs(ak, bk, ak)
+	r.INTT(ak)
+	if !ak.Equal(want) {
+		panic("Failure")
+	}
+
+	kinv := new(big.Int).ModInverse(big.NewInt(int64(k)), big.NewInt(int64(2*r.N))).Uint64()
+	back := r.NewPoly()
+	r.Automorphism(want, kinv, back)
+	if !back.Equal(ab) {
+		panic("Failure")
+	}
+}
+
+func TestDivRoundByLastModulus(t *testing.T) {
+	r := testRing(testLogN, 3)
+	p := r.UniformPoly(rand.Reader)
+	out := r.DivRoundByLastModulus(p)
+	lower := r.AtLevel(1)
+
+	qL := new(big.Int).SetUint64(r.Moduli[2])
+	half := new(big.Int).Rsh(qL, 1)
+	for j := uint64(0); j < r.N; j++ {
+		want := r.CRT(p, j)
+		want.Add(want, half).Quo(want, qL).Mod(want, lower.Modulus())
+		if lower.CRT(out, j).Cmp(want) != 0 {
+			panic("Failure")
+		}
+	}
+}
+
+// Test that modulus switching preserves the message of a ciphertext.
+func TestModSwitchCiphertext(t *testing.T) {
+	r := testRing(testLogN, 3)
+	lower := r.AtLevel(1)
+	tmod := uint64(1 << 16)
+	s := r.TernaryPoly(rand.Reader)
+	m := randomMessage(r, tmod)
+
+	c0, c1 := encrypt(r, s, m, tmod)
+	c0 = r.DivRoundByLastModulus(c0)
+	c1 = r.DivRoundByLastModulus(c1)
+	s_low := &Poly{Coeffs: s.Coeffs[:2]}
+
+	got := decrypt(lower, s_low, c0, c1, tmod)
+	for j := range m {
+		if got[j] != m[j] {
+			panic("Failure")
+		}
+	}
+}
+
+func TestKeySwitch(t *testing.T) {
+	r := testRing(testLogN, 2)
+	tmod := uint64(1 << 16)
+	s := r.TernaryPoly(rand.Reader)
+	s2 := r.TernaryPoly(rand.Reader)
+	key := r.GenKeySwitchKey(s, s2, 10, testEta, rand.Reader)
+
+	m := randomMessage(r, tmod)
+	c0, c1 := encrypt(r, s, m, tmod)
+	d0, d1 := r.KeySwitch(c1, key)
+	r.INTT(d0)
+	r.INTT(d1)
+	r.Add(d0, c0, d0)
+
+	got := decrypt(r, s2, d0, d1, tmod)
+	for j := range m {
+		if got[j] != m[j] {
+			panic("Failure")
+		}
+	}
+}
+
+func TestGalois(t *testing.T) {
+	r := testRing(testLogN, 2)
+	tmod := uint64(1 << 16)
+	k := uint64(2*r.N - 1)
+	s := r.TernaryPoly(rand.Reader)
+	key := r.GenGaloisKey(s, k, 10, testEta, rand.Reader)
+
+	m := randomMessage(r, tmod)
+	c0, c1 := encrypt(r, s, m, tmod)
+	c0, c1 = r.ApplyGalois(c0, c1, k, key)
+
+	// m(X^-1) has coefficients m_0, -m_(N-1), ..., -m_1
+	got := decrypt(r, s, c0, c1, tmod)
+	for j := uint64(0); j < r.N; j++ {
+		want := m[0]
+		if j > 0 {
+			want = (tmod - m[r.N-j]) % tmod
+		}
+		if got[j] != want {
+			panic("Failure")
+		}
+	}
+}
+
+func BenchmarkNTT(b *testing.B) {
+	r := testRing(testLogN, 2)
+	p := r.UniformPoly(rand.Reader)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.NTT(p)
+	}
+}
+
+func BenchmarkINTT(b *testing.B) {
+	r := testRing(testLogN, 2)
+	p := r.UniformPoly(rand.Reader)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.INTT(p)
+	}
+}
+
+func BenchmarkMulCoeffsAdd(b *testing.B) {
+	r := testRing(testLogN, 2)
+	x := r.UniformPoly(rand.Reader)
+	y := r.UniformPoly(rand.Reader)
+	acc := r.NewPoly()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.MulCoeffsAdd(x, y, acc)
+	}
+}
+
+func BenchmarkKeySwitch(b *testing.B) {
+	r := testRing(testLogN, 2)
+	s := r.TernaryPoly(rand.Reader)
+	key := r.GenKeySwitchKey(s, r.TernaryPoly(rand.Reader), 10, testEta, rand.Reader)
+	c := r.UniformPoly(rand.Reader)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.KeySwitch(c, key)
+	}
+}
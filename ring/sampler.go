@@ -0,0 +1,74 @@
+package ring
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// Sampling of polynomials (in coefficient form) from a stream of random bytes,
+// such as a seeded PRG. The output is a fixed function of the stream, so that
+// parties that share a seed sample the same polynomials.
+
+func readFull(rand io.Reader, buf []byte) {
+	if _, err := io.ReadFull(rand, buf); err != nil {
+		panic("Should never get here")
+	}
+}
+
+// Returns a uniform polynomial of R_Q. Its residues are rejection sampled from
+// little-endian 64-bit words, masked to the bit length of each modulus, so it
+// is uniform mod Q in either domain.
+func (r *Ring) UniformPoly(rand io.Reader) *Poly {
+	p := r.NewPoly()
+	buf := make([]byte, 8*r.N)
+	for i, q := range r.Moduli {
+		mask := uint64(1)<<bits.Len64(q) - 1
+		for j := uint64(0); j < r.N; {
+			n := 8 * (r.N - j)
+			readFull(rand, buf[:n])
+			for k := uint64(0); k < n; k += 8 {
+				if v := binary.LittleEndian.Uint64(buf[k:]) & mask; v < q {
+					p.Coeffs[i][j] = v
+					j += 1
+				}
+			}
+		}
+	}
+	return p
+}
+
+// Returns a polynomial with uniform coefficients in {-1, 0, 1}, for secrets.
+func (r *Ring) TernaryPoly(rand io.Reader) *Poly {
+	p := r.NewPoly()
+	buf := make([]byte, r.N)
+	for j := uint64(0); j < r.N; {
+		n := r.N - j
+		readFull(rand, buf[:n])
+		for _, b := range buf[:n] {
+			if b < 255 {
+				r.SetCoeff(p, j, int64(b%3)-1)
+				j += 1
+			}
+		}
+	}
+	return p
+}
+
+// Returns a polynomial with centered binomial coefficients of parameter
+// eta <= 32 (with stddev sqrt(eta/2)), for errors.
+func (r *Ring) CBDPoly(rand io.Reader, eta uint64) *Poly {
+	if eta == 0 || eta > 32 {
+		panic("Bad binomial parameter")
+	}
+	p := r.NewPoly()
+	buf := make([]byte, 8*r.N)
+	readFull(rand, buf)
+	mask := uint64(1)<<eta - 1
+	for j := uint64(0); j < r.N; j++ {
+		x := binary.LittleEndian.Uint64(buf[8*j:])
+		e := bits.OnesCount64(x&mask) - bits.OnesCount64((x>>eta)&mask)
+		r.SetCoeff(p, j, int64(e))
+	}
+	return p
+}